@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+const (
+	adminAddr = "/run/%v/%vadmin.sock"
+)
+
+func getAdminAddr(groupname, dmprefix string) string {
+	// Instances managing different pools get sockets of their own
+	return fmt.Sprintf(adminAddr, driverName, getDmPrefix(groupname, dmprefix))
+}
+
+type adminHandler func(d *overlitDriver, args []string) (string, error)
+
+var adminHandlers = map[string]adminHandler{
+	"defrag": adminDefrag,
+	"adddev": adminAddDev,
+	"grow":   adminGrow,
+	"groups": adminGroups,
+	"quota":  adminQuota,
+	"fsck":   adminFsck,
+	"gc":     adminGC,
+}
+
+func adminDefrag(d *overlitDriver, args []string) (string, error) {
+	before, after, err := d.dmtool.Defrag()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("before: %v\nafter: %v\n", before, after), nil
+}
+
+func adminAddDev(d *overlitDriver, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("usage: adddev <devpath>")
+	}
+
+	if err := d.dmtool.AddBackingDevice(args[0]); err != nil {
+		return "", err
+	}
+
+	if err := d.dmtool.Flush(); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("added %v\n", args[0]), nil
+}
+
+func adminGrow(d *overlitDriver, args []string) (string, error) {
+	grown, err := d.growBackingDevices()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("grown %v\n", grown), nil
+}
+
+func adminGroups(d *overlitDriver, args []string) (string, error) {
+	out := ""
+
+	for _, name := range d.dmtool.GetGroups() {
+		quota, _ := d.dmtool.GetGroupQuota(name)
+		used, _ := d.dmtool.GetGroupUsage(name)
+
+		out += fmt.Sprintf("%v: used = %v, quota = %v\n", name, units.BytesSize(float64(used)), units.BytesSize(float64(quota)))
+	}
+
+	return out, nil
+}
+
+func adminQuota(d *overlitDriver, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errors.New("usage: quota <group> <size>")
+	}
+
+	quota, err := units.RAMInBytes(args[1])
+	if err != nil {
+		return "", err
+	}
+
+	if err := d.dmtool.SetGroupQuota(args[0], uint64(quota)); err != nil {
+		return "", err
+	}
+
+	if err := d.dmtool.Flush(); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%v: quota = %v\n", args[0], units.BytesSize(float64(quota))), nil
+}
+
+func adminFsck(d *overlitDriver, args []string) (string, error) {
+	if len(args) > 1 || (len(args) == 1 && args[0] != fsckRepair) {
+		return "", errors.New("usage: fsck [repair]")
+	}
+
+	repair := len(args) == 1
+
+	problems, err := d.fsck(repair)
+	if err != nil {
+		return "", err
+	}
+
+	if repair {
+		if err := d.dmtool.Flush(); err != nil {
+			return "", err
+		}
+	}
+
+	out := ""
+
+	for _, problem := range problems {
+		out += fmt.Sprintf("%v\n", problem)
+	}
+
+	out += fmt.Sprintf("%v problems\n", len(problems))
+
+	return out, nil
+}
+
+func adminGC(d *overlitDriver, args []string) (string, error) {
+	if len(args) > 1 || (len(args) == 1 && args[0] != gcDryRun) {
+		return "", errors.New("usage: gc [dryrun]")
+	}
+
+	garbages, err := d.gc(len(args) == 1)
+	if err != nil {
+		return "", err
+	}
+
+	out := ""
+
+	for _, garbage := range garbages {
+		out += fmt.Sprintf("%v\n", garbage)
+	}
+
+	out += fmt.Sprintf("%v garbages\n", len(garbages))
+
+	return out, nil
+}
+
+func (d *overlitDriver) ServeAdmin(addr string) error {
+	if err := os.MkdirAll(path.Dir(addr), 0700); err != nil {
+		return err
+	}
+
+	// A socket that still answers belongs to a running instance, only a stale one is replaced
+	if conn, err := net.Dial("unix", addr); err == nil {
+		conn.Close()
+		return errors.Errorf("%v admin socket is in use", addr)
+	}
+	os.Remove(addr)
+
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+
+	for command, handler := range adminHandlers {
+		command, handler := command, handler
+
+		mux.HandleFunc("/"+command, func(w http.ResponseWriter, r *http.Request) {
+			log.Printf("overlit: admin (command = %v, args = %v)\n", command, r.URL.Query()["arg"])
+
+			if d.home == "" {
+				http.Error(w, "driver is not initialized", http.StatusServiceUnavailable)
+				return
+			}
+
+			out, err := handler(d, r.URL.Query()["arg"])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			fmt.Fprint(w, out)
+		})
+	}
+
+	return http.Serve(l, mux)
+}
+
+func runAdmin(addr, command string, args []string) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("unix", addr)
+			},
+		},
+	}
+
+	resp, err := client.PostForm(fmt.Sprintf("http://%v/%v?%v", driverName, command, url.Values{"arg": args}.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%v failed: %s", command, out)
+	}
+
+	fmt.Print(string(out))
+
+	return nil
+}
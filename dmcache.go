@@ -0,0 +1,423 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/willf/bitset"
+)
+
+const (
+	cacheModeWriteCache = "writecache"
+	cacheModeCache      = "cache"
+
+	cachePolicyRW  = "rw"
+	cachePolicyHot = "hot"
+	cachePolicyAll = "all"
+
+	// dm-cache tracks its blocks in 256KiB units and needs about 16 bytes of metadata for each
+	cacheBlockSectors    = 512
+	cacheMetaBlockBytes  = 16
+	cacheMetaExtraBytes  = 4 * 1024 * 1024
+	cacheSuperblockBytes = 4096
+)
+
+func (d *DmTool) setupCache(cachepath, cachemode string, cachesize uint64) error {
+	// Dirty blocks of writecache devices only live on the cache device they were written to
+	if d.CachePath != "" && d.CachePath != cachepath {
+		for name, device := range d.Devices {
+			if device.CacheMode != "" {
+				return errors.Errorf("%v device is cached on %v", name, d.CachePath)
+			}
+		}
+	}
+
+	d.CachePath = cachepath
+	d.cachemode = cachemode
+	d.cachesize = cachesize
+	d.cache = nil
+
+	if cachepath == "" {
+		return nil
+	}
+
+	devsize := getDeviceSize(cachepath)
+	if devsize == 0 {
+		return errors.Errorf("%v cache device is not available", cachepath)
+	}
+
+	extents := devsize / d.ExtentSize
+
+	log.Printf("overlit: add cache device (devpath = %v, devsize = %v bytes, extents = %v)\n", cachepath, devsize, extents)
+
+	d.cache = &dmBacking{
+		extents:    extents,
+		extentbits: bitset.New(uint(extents)),
+	}
+
+	return nil
+}
+
+func (d *DmTool) setCacheExtents(targets []DmExtentRun, used bool) {
+	if d.cache == nil {
+		return
+	}
+
+	for _, target := range targets {
+		for i := uint64(0); i < target.Count; i++ {
+			if used {
+				d.cache.extentbits.Set(uint(target.Start + i + 1))
+			} else {
+				d.cache.extentbits.Clear(uint(target.Start + i + 1))
+			}
+		}
+	}
+}
+
+func (d *DmTool) allocateCacheTargets(count uint64) ([]DmExtentRun, error) {
+	allocated := []DmExtentRun{}
+
+	// Cache extents never move, so the first free ones are as good as any
+	for extent := getNextFreeExtent(d.cache.extentbits, 0); extent < d.cache.extents && count > 0; {
+		end := getMinUint64(getNextUsedExtent(d.cache.extentbits, extent), d.cache.extents)
+		take := getMinUint64(end-extent, count)
+
+		allocated = append(allocated, DmExtentRun{0, extent, take})
+
+		count -= take
+
+		extent = getNextFreeExtent(d.cache.extentbits, end)
+	}
+
+	if count > 0 {
+		return nil, errors.New("could not allocate cache extents")
+	}
+
+	d.setCacheExtents(allocated, true)
+
+	return allocated, nil
+}
+
+func (d *DmTool) getCacheLinearTargets(targets []DmExtentRun) []dmTarget {
+	multis := uint64(d.ExtentSize / 512)
+
+	linears := []dmTarget{}
+	offset := uint64(0)
+
+	for _, target := range targets {
+		linears = append(linears, dmTarget{offset * multis, target.Count * multis, "linear", fmt.Sprintf("%v %v", d.CachePath, target.Start*multis)})
+
+		offset += target.Count
+	}
+
+	return linears
+}
+
+func (d *DmTool) getCacheMetaExtents(extents uint64) uint64 {
+	blocks := extents * d.ExtentSize / (cacheBlockSectors * 512)
+
+	return getMaxUint64((blocks*cacheMetaBlockBytes+cacheMetaExtraBytes+d.ExtentSize-1)/d.ExtentSize, 1)
+}
+
+func (d *DmTool) splitCacheTargets(device *DmDevice) ([]DmExtentRun, []DmExtentRun) {
+	if device.CacheMode != cacheModeCache {
+		return nil, device.CacheTargets
+	}
+
+	// dm-cache keeps its metadata in the first extents of the cache targets
+	metas := []DmExtentRun{}
+	datas := []DmExtentRun{}
+
+	count := d.getCacheMetaExtents(getTargetsCount(device.CacheTargets))
+
+	for _, target := range device.CacheTargets {
+		if count > 0 {
+			take := getMinUint64(count, target.Count)
+
+			metas = append(metas, DmExtentRun{target.Device, target.Start, take})
+
+			target.Start += take
+			target.Count -= take
+			count -= take
+		}
+
+		if target.Count > 0 {
+			datas = append(datas, target)
+		}
+	}
+
+	return metas, datas
+}
+
+func (d *DmTool) getCacheLayers(name string, device *DmDevice, lower string) []dmLayer {
+	metas, datas := d.splitCacheTargets(device)
+
+	cdata := name + "-" + cacheDataLayer
+	upper := name + "-" + cacheLayer
+
+	layers := []dmLayer{}
+
+	if device.CacheMode == cacheModeWriteCache {
+		layers = append(layers, dmLayer{name: cdata, table: d.getCacheLinearTargets(datas), writable: true})
+		layers = append(layers, dmLayer{name: upper, table: []dmTarget{
+			{0, device.Extents * d.ExtentSize / 512, "writecache", fmt.Sprintf("s %v %v 4096 0", lower, d.GetDevicePath(cdata))},
+		}, writable: true})
+
+		return layers
+	}
+
+	cmeta := name + "-" + cacheMetaLayer
+
+	// Read-only layers never have dirty blocks, so writethrough keeps the origin complete
+	layers = append(layers, dmLayer{name: cmeta, table: d.getCacheLinearTargets(metas), writable: true})
+	layers = append(layers, dmLayer{name: cdata, table: d.getCacheLinearTargets(datas), writable: true})
+	layers = append(layers, dmLayer{name: upper, table: []dmTarget{
+		{0, device.Extents * d.ExtentSize / 512, "cache", fmt.Sprintf("%v %v %v %v 1 writethrough smq 0", d.GetDevicePath(cmeta), d.GetDevicePath(cdata), lower, cacheBlockSectors)},
+	}, writable: true})
+
+	return layers
+}
+
+func (d *DmTool) wipeCacheSuperblock(targets []DmExtentRun) error {
+	f, err := os.OpenFile(d.CachePath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Both targets format a cache whose superblock is zeroed and reject one with stale data
+	if _, err := f.WriteAt(make([]byte, cacheSuperblockBytes), int64(targets[0].Start*d.ExtentSize)); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func (d *DmTool) getEvictableCache(name string, extents uint64) string {
+	if d.cache.extents-uint64(d.cache.extentbits.Count()) >= extents {
+		return ""
+	}
+
+	// Only read caches hold nothing but copies, writecache devices keep their dirty blocks
+	victim := ""
+	for candidate, device := range d.Devices {
+		if candidate == name || device.CacheMode != cacheModeCache || !device.Readonly || device.Removing || device.Reclaiming {
+			continue
+		}
+
+		if victim == "" || d.cacheused[candidate] < d.cacheused[victim] {
+			victim = candidate
+		}
+	}
+
+	return victim
+}
+
+func (d *DmTool) AttachCache(name string) error {
+	for {
+		victim, err := d.attachCache(name)
+		if victim == "" {
+			return err
+		}
+
+		log.Printf("overlit: evict cache (device = %v, for = %v)\n", victim, name)
+
+		if err := d.DetachCache(victim); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *DmTool) attachCache(name string) (string, error) {
+	d.locker.Lock(name)
+	defer d.locker.Unlock(name)
+
+	d.mu.Lock()
+
+	device, ok := d.Devices[name]
+	if !ok {
+		d.mu.Unlock()
+		return "", errors.Errorf("has no %v device", name)
+	}
+	if d.cache == nil || device.Extents == 0 || device.Removing || device.Reclaiming {
+		d.mu.Unlock()
+		return "", nil
+	}
+
+	d.cacheclock++
+	d.cacheused[name] = d.cacheclock
+
+	if device.CacheMode != "" {
+		d.mu.Unlock()
+		return "", nil
+	}
+
+	// Writes of read-only layers are done, only reads are worth caching there
+	mode := d.cachemode
+	if device.Readonly {
+		mode = cacheModeCache
+	}
+
+	extents := d.cachesize / d.ExtentSize
+	if mode == cacheModeCache {
+		extents += d.getCacheMetaExtents(extents)
+	}
+	extents = getMaxUint64(extents, 1)
+
+	if victim := d.getEvictableCache(name, extents); victim != "" {
+		d.mu.Unlock()
+		return victim, nil
+	}
+
+	targets, err := d.allocateCacheTargets(extents)
+	if err != nil {
+		d.mu.Unlock()
+		return "", err
+	}
+
+	cached := device.clone()
+	cached.CacheMode = mode
+	cached.CacheTargets = targets
+
+	seq, err := d.beginJournal("cache", name, device, cached)
+	if err != nil {
+		d.setCacheExtents(targets, false)
+		d.mu.Unlock()
+		return "", err
+	}
+
+	stack := d.getDeviceStack(name, cached)
+	metas, datas := d.splitCacheTargets(cached)
+	d.mu.Unlock()
+
+	// The record has to be on disk before the kernel sees the new stack
+	err = d.syncJournal()
+
+	if err == nil {
+		if len(metas) > 0 {
+			err = d.wipeCacheSuperblock(metas)
+		} else {
+			err = d.wipeCacheSuperblock(datas)
+		}
+	}
+
+	if err == nil {
+		err = d.activateStack(stack, cached.Sealed)
+	}
+
+	d.mu.Lock()
+
+	if err != nil {
+		d.setCacheExtents(targets, false)
+		d.abortJournal(seq)
+		d.mu.Unlock()
+
+		return "", err
+	}
+
+	log.Printf("overlit: attach cache (device = %v, mode = %v, extents = %v)\n", name, mode, getTargetsCount(targets))
+
+	*device = *cached
+
+	err = d.commitJournal(seq)
+	d.mu.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+
+	return "", d.syncJournal()
+}
+
+func (d *DmTool) DetachCache(name string) error {
+	d.locker.Lock(name)
+	defer d.locker.Unlock(name)
+
+	d.mu.Lock()
+
+	device, ok := d.Devices[name]
+	if !ok {
+		d.mu.Unlock()
+		return errors.Errorf("has no %v device", name)
+	}
+	if device.CacheMode == "" || device.Removing || device.Reclaiming {
+		d.mu.Unlock()
+		return nil
+	}
+
+	// Dirty blocks of writecache would have to be flushed back first
+	if device.CacheMode != cacheModeCache {
+		d.mu.Unlock()
+		return errors.Errorf("not supported detach of %v cache", device.CacheMode)
+	}
+
+	uncached := device.clone()
+	uncached.CacheMode = ""
+	uncached.CacheTargets = nil
+
+	seq, err := d.beginJournal("uncache", name, device, uncached)
+	if err != nil {
+		d.mu.Unlock()
+		return err
+	}
+
+	stack := d.getDeviceStack(name, device)
+	ustack := d.getDeviceStack(name, uncached)
+	d.mu.Unlock()
+
+	// The layers above the cache are pointed at the origin before the cache layers go away
+	err = d.syncJournal()
+	if err == nil {
+		if err = d.activateStack(ustack, uncached.Sealed); err != nil {
+			d.activateStack(stack, device.Sealed)
+		}
+	}
+
+	if err != nil {
+		d.mu.Lock()
+		d.abortJournal(seq)
+		d.mu.Unlock()
+
+		return err
+	}
+
+	names := make(map[string]bool)
+	for _, layer := range ustack {
+		names[layer.name] = true
+	}
+
+	stale := []dmLayer{}
+	for _, layer := range stack {
+		if !names[layer.name] {
+			stale = append(stale, layer)
+		}
+	}
+
+	derr := d.detachStack(stale)
+
+	d.mu.Lock()
+
+	log.Printf("overlit: detach cache (device = %v, extents = %v)\n", name, getTargetsCount(device.CacheTargets))
+
+	// Cache layers left in the kernel still map their extents, so those are not handed out again
+	if derr == nil {
+		d.setCacheExtents(device.CacheTargets, false)
+	}
+
+	*device = *uncached
+	delete(d.cacheused, name)
+
+	err = d.commitJournal(seq)
+	d.mu.Unlock()
+
+	if jerr := d.syncJournal(); jerr != nil && err == nil {
+		err = jerr
+	}
+	if derr != nil && err == nil {
+		err = errors.Wrap(derr, "could not remove cache layers")
+	}
+
+	return err
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type DmKeyProvider interface {
+	// GetKey returns the dm-crypt key argument of a device, a missing key is only made if create is set
+	GetKey(name string, size int, create bool) (string, error)
+	// DeleteKey discards the key for good, deleting a missing key is not an error
+	DeleteKey(name string) error
+}
+
+type fileKeyProvider struct {
+	dir string
+}
+
+// Keys of the kernel keyring are gone after a reboot, so encrypted layers only outlive a daemon restart
+type keyringKeyProvider struct{}
+
+type serviceKeyProvider struct {
+	client *http.Client
+}
+
+func getDmKeyProvider(spec string) (DmKeyProvider, error) {
+	kind, arg := spec, ""
+	if index := strings.Index(spec, ":"); index >= 0 {
+		kind, arg = spec[:index], spec[index+1:]
+	}
+
+	switch kind {
+	case "file":
+		if arg == "" {
+			return nil, errors.New("file key provider has no directory")
+		}
+
+		if err := os.MkdirAll(arg, 0700); err != nil {
+			return nil, errors.Wrap(err, "could not create key directory")
+		}
+
+		return &fileKeyProvider{dir: arg}, nil
+	case "keyring":
+		log.Printf("overlit: keyring key provider loses keys at reboot, encrypted layers of stopped containers will not come back\n")
+
+		return &keyringKeyProvider{}, nil
+	case "service":
+		if arg == "" {
+			return nil, errors.New("service key provider has no socket")
+		}
+
+		return newServiceKeyProvider(arg), nil
+	}
+
+	return nil, errors.Errorf("not supported %v key provider", kind)
+}
+
+// Ciphers go into the table text as they are, so only cipher-chainmode-ivmode[:ivopts] is taken
+var cryptCipherPattern = regexp.MustCompile(`^[a-z0-9_]+-[a-z0-9_]+-[a-z0-9_]+(:[a-z0-9_]+)?$`)
+
+func checkCryptCipher(cipher string) error {
+	if !cryptCipherPattern.MatchString(cipher) {
+		return errors.Errorf("not supported %q cipher", cipher)
+	}
+
+	return nil
+}
+
+func getCryptKeySize(cipher string) int {
+	// XTS splits the key into two halves, one for the data and one for the tweak
+	if strings.Contains(cipher, "-xts-") {
+		return 64
+	}
+
+	return 32
+}
+
+func makeKey(size int) ([]byte, error) {
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "could not make key")
+	}
+
+	return key, nil
+}
+
+func (p *fileKeyProvider) getKeyPath(name string) string {
+	return path.Join(p.dir, name+".key")
+}
+
+func (p *fileKeyProvider) GetKey(name string, size int, create bool) (string, error) {
+	key, err := ioutil.ReadFile(p.getKeyPath(name))
+	if err == nil {
+		return hex.EncodeToString(key), nil
+	}
+	if !os.IsNotExist(err) || !create {
+		return "", errors.Wrapf(err, "could not read %v key", name)
+	}
+
+	if key, err = makeKey(size); err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(p.getKeyPath(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not create %v key", name)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(key); err != nil {
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(key), nil
+}
+
+func (p *fileKeyProvider) DeleteKey(name string) error {
+	if err := os.Remove(p.getKeyPath(name)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "could not delete %v key", name)
+	}
+
+	return nil
+}
+
+func (p *keyringKeyProvider) getKeyDesc(name string) string {
+	// Logon keys can not be read back from user space, only dm-crypt gets them
+	return "overlit:" + name
+}
+
+func (p *keyringKeyProvider) GetKey(name string, size int, create bool) (string, error) {
+	desc := p.getKeyDesc(name)
+
+	if _, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "logon", desc, 0); err != nil {
+		if !create {
+			return "", errors.Wrapf(err, "could not find %v key", name)
+		}
+
+		key, err := makeKey(size)
+		if err != nil {
+			return "", err
+		}
+
+		if _, err := unix.AddKey("logon", desc, key, unix.KEY_SPEC_USER_KEYRING); err != nil {
+			return "", errors.Wrapf(err, "could not add %v key", name)
+		}
+	}
+
+	return fmt.Sprintf(":%v:logon:%v", size, desc), nil
+}
+
+func (p *keyringKeyProvider) DeleteKey(name string) error {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "logon", p.getKeyDesc(name), 0)
+	if err != nil {
+		return nil
+	}
+
+	if _, err := unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0); err != nil {
+		return errors.Wrapf(err, "could not delete %v key", name)
+	}
+
+	return nil
+}
+
+func newServiceKeyProvider(sockpath string) *serviceKeyProvider {
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", sockpath)
+	}
+
+	return &serviceKeyProvider{
+		client: &http.Client{Transport: &http.Transport{DialContext: dial}},
+	}
+}
+
+func (p *serviceKeyProvider) request(method, name string, size int, create bool) (*http.Response, error) {
+	url := fmt.Sprintf("http://keyservice/keys/%v?size=%v&create=%t", name, size, create)
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.client.Do(req)
+}
+
+func (p *serviceKeyProvider) GetKey(name string, size int, create bool) (string, error) {
+	res, err := p.request(http.MethodGet, name, size, create)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not get %v key", name)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Errorf("could not get %v key (status = %v)", name, res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	// The service hands out hex keys, anything else would end up in the table as it is
+	key := strings.TrimSpace(string(body))
+	if raw, err := hex.DecodeString(key); err != nil || len(raw) != size {
+		return "", errors.Errorf("could not parse %v key", name)
+	}
+
+	return key, nil
+}
+
+func (p *serviceKeyProvider) DeleteKey(name string) error {
+	res, err := p.request(http.MethodDelete, name, 0, false)
+	if err != nil {
+		return errors.Wrapf(err, "could not delete %v key", name)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return errors.Errorf("could not delete %v key (status = %v)", name, res.StatusCode)
+	}
+
+	return nil
+}
+
+func (d *DmTool) getCryptTable(device *DmDevice, lowerpath, key string) []dmTarget {
+	multis := uint64(d.ExtentSize / 512)
+
+	return []dmTarget{
+		{0, device.Extents * multis, "crypt", fmt.Sprintf("%v %v 0 %v 0", device.Cipher, key, lowerpath)},
+	}
+}
+
+func (d *DmTool) loadKey(name string, device *DmDevice, create bool) (string, error) {
+	if d.keyprovider == nil {
+		return "", errors.New("has no key provider")
+	}
+
+	// Keys follow the layer id, so they survive a change of the device prefix
+	return d.keyprovider.GetKey(name, getCryptKeySize(device.Cipher), create)
+}
+
+func (d *DmTool) discardKey(name string) error {
+	if d.keyprovider == nil {
+		return nil
+	}
+
+	return d.keyprovider.DeleteKey(name)
+}
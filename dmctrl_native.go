@@ -0,0 +1,563 @@
+//go:build dmnative
+// +build dmnative
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	dmVersionCmd = iota
+	dmRemoveAllCmd
+	dmListDevicesCmd
+	dmDevCreateCmd
+	dmDevRemoveCmd
+	dmDevRenameCmd
+	dmDevSuspendCmd
+	dmDevStatusCmd
+	dmDevWaitCmd
+	dmTableLoadCmd
+	dmTableClearCmd
+	dmTableDepsCmd
+	dmTableStatusCmd
+	dmListVersionsCmd
+	dmTargetMsgCmd
+	dmDevSetGeometryCmd
+)
+
+const (
+	dmReadonlyFlag        = 1 << 0
+	dmSuspendFlag         = 1 << 1
+	dmStatusTableFlag     = 1 << 4
+	dmActivePresentFlag   = 1 << 5
+	dmInactivePresentFlag = 1 << 6
+	dmBufferFullFlag      = 1 << 8
+	dmDeferredRemoveFlag  = 1 << 17
+
+	dmIoctlType      = 0xfd
+	dmIoctlSize      = 312
+	dmTargetSpecSize = 40
+	dmNameLen        = 128
+	dmMaxTypeName    = 16
+	dmBufferSize     = 16 * 1024
+
+	dmControlPath = "/dev/mapper/control"
+	dmControlDev  = "/sys/class/misc/device-mapper/dev"
+)
+
+// dmIoctl mirrors struct dm_ioctl of linux/dm-ioctl.h
+type dmIoctl struct {
+	Version     [3]uint32
+	DataSize    uint32
+	DataStart   uint32
+	TargetCount uint32
+	OpenCount   int32
+	Flags       uint32
+	EventNr     uint32
+	Padding     uint32
+	Dev         uint64
+	Name        [dmNameLen]byte
+	Uuid        [129]byte
+	Data        [7]byte
+}
+
+// dmTargetSpec mirrors struct dm_target_spec of linux/dm-ioctl.h
+type dmTargetSpec struct {
+	SectorStart uint64
+	Length      uint64
+	Status      int32
+	Next        uint32
+	TargetType  [dmMaxTypeName]byte
+}
+
+type dmTask struct {
+	taskType int
+	name     string
+	newname  string
+	message  string
+	sector   uint64
+	readonly bool
+	deferred bool
+	targets  []dmTarget
+
+	errno  int
+	exists bool
+	header dmIoctl
+	data   []byte
+}
+
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	i := uint16(1)
+	if *(*byte)(unsafe.Pointer(&i)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+var dmCommands = map[int]uint32{
+	deviceCreate:       dmDevCreateCmd,
+	deviceReload:       dmTableLoadCmd,
+	deviceRemove:       dmDevRemoveCmd,
+	deviceRemoveAll:    dmRemoveAllCmd,
+	deviceSuspend:      dmDevSuspendCmd,
+	deviceResume:       dmDevSuspendCmd,
+	deviceInfo:         dmDevStatusCmd,
+	deviceDeps:         dmTableDepsCmd,
+	deviceRename:       dmDevRenameCmd,
+	deviceVersion:      dmVersionCmd,
+	deviceStatus:       dmTableStatusCmd,
+	deviceTable:        dmTableStatusCmd,
+	deviceWaitevent:    dmDevWaitCmd,
+	deviceList:         dmListDevicesCmd,
+	deviceClear:        dmTableClearCmd,
+	deviceMknodes:      dmDevStatusCmd,
+	deviceListVersions: dmListVersionsCmd,
+	deviceTargetMsg:    dmTargetMsgCmd,
+	deviceSetGeometry:  dmDevSetGeometryCmd,
+}
+
+func getIoctlRequest(cmd uint32) uintptr {
+	// _IOWR(DM_IOCTL, cmd, struct dm_ioctl)
+	return uintptr(3<<30 | dmIoctlSize<<16 | dmIoctlType<<8 | cmd)
+}
+
+func getCString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+
+	return string(b)
+}
+
+func openControl() (*os.File, error) {
+	f, err := os.OpenFile(dmControlPath, os.O_RDWR, 0)
+	if err == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+
+	// Without udev nobody else creates the control node
+	buf, err := ioutil.ReadFile(dmControlDev)
+	if err != nil {
+		return nil, err
+	}
+
+	var major, minor uint32
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(buf)), "%d:%d", &major, &minor); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(path.Dir(dmControlPath), 0755); err != nil {
+		return nil, err
+	}
+	if err := unix.Mknod(dmControlPath, unix.S_IFCHR|0600, int(unix.Mkdev(major, minor))); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+
+	return os.OpenFile(dmControlPath, os.O_RDWR, 0)
+}
+
+func (task *dmTask) getPayload(taskType int) []byte {
+	payload := &bytes.Buffer{}
+
+	switch taskType {
+	case deviceReload:
+		for _, target := range task.targets {
+			params := append([]byte(target.params), 0)
+			size := (dmTargetSpecSize + len(params) + 7) &^ 7
+
+			spec := dmTargetSpec{
+				SectorStart: target.start,
+				Length:      target.size,
+				Next:        uint32(size),
+			}
+			copy(spec.TargetType[:dmMaxTypeName-1], target.ttype)
+
+			binary.Write(payload, nativeEndian, &spec)
+			payload.Write(params)
+			payload.Write(make([]byte, size-dmTargetSpecSize-len(params)))
+		}
+
+	case deviceRename:
+		payload.WriteString(task.newname)
+		payload.WriteByte(0)
+
+	case deviceTargetMsg:
+		binary.Write(payload, nativeEndian, task.sector)
+		payload.WriteString(task.message)
+		payload.WriteByte(0)
+	}
+
+	return payload.Bytes()
+}
+
+func (task *dmTask) ioctl(taskType int, flags uint32) error {
+	f, err := openControl()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	payload := task.getPayload(taskType)
+
+	size := getMaxUint64(uint64(dmIoctlSize+len(payload)), dmBufferSize)
+
+	for {
+		header := dmIoctl{
+			Version:   [3]uint32{4, 0, 0},
+			DataSize:  uint32(size),
+			DataStart: dmIoctlSize,
+			Flags:     flags,
+		}
+		copy(header.Name[:dmNameLen-1], task.name)
+
+		if taskType == deviceReload {
+			header.TargetCount = uint32(len(task.targets))
+		}
+
+		buf := &bytes.Buffer{}
+		binary.Write(buf, nativeEndian, &header)
+		buf.Write(payload)
+
+		data := make([]byte, size)
+		copy(data, buf.Bytes())
+
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), getIoctlRequest(dmCommands[taskType]), uintptr(unsafe.Pointer(&data[0]))); errno != 0 {
+			return errno
+		}
+
+		if err := binary.Read(bytes.NewReader(data[:dmIoctlSize]), nativeEndian, &task.header); err != nil {
+			return err
+		}
+
+		// The kernel tells us when the results did not fit, so try again with a larger buffer
+		if task.header.Flags&dmBufferFullFlag != 0 {
+			size *= 2
+			continue
+		}
+
+		end := getMinUint64(uint64(task.header.DataSize), size)
+		start := getMinUint64(uint64(task.header.DataStart), end)
+
+		task.data = data[start:end]
+
+		return nil
+	}
+}
+
+func (task *dmTask) run() error {
+	var flags uint32
+
+	if task.readonly {
+		flags |= dmReadonlyFlag
+	}
+
+	switch task.taskType {
+	case deviceCreate:
+		if err := task.ioctl(deviceCreate, 0); err != nil {
+			return err
+		}
+		if len(task.targets) == 0 {
+			return nil
+		}
+
+		// Like libdevmapper a create with targets also loads and resumes the table
+		if err := task.ioctl(deviceReload, flags); err != nil {
+			task.ioctl(deviceRemove, 0)
+			return err
+		}
+		if err := task.ioctl(deviceResume, 0); err != nil {
+			task.ioctl(deviceRemove, 0)
+			return err
+		}
+
+		return nil
+
+	case deviceReload:
+		return task.ioctl(deviceReload, flags)
+
+	case deviceRemove:
+		if task.deferred {
+			flags |= dmDeferredRemoveFlag
+		}
+
+		return task.ioctl(deviceRemove, flags)
+
+	case deviceSuspend:
+		return task.ioctl(deviceSuspend, dmSuspendFlag)
+
+	case deviceTable:
+		return task.ioctl(deviceTable, dmStatusTableFlag)
+
+	case deviceInfo, deviceMknodes, deviceStatus:
+		// A missing device is no error, it only does not exist
+		if err := task.ioctl(task.taskType, 0); err != nil {
+			if err == syscall.ENXIO {
+				task.exists = false
+				return nil
+			}
+
+			return err
+		}
+
+		return nil
+	}
+
+	return task.ioctl(task.taskType, 0)
+}
+
+func dmTaskCreate(taskType int) *dmTask {
+	if _, ok := dmCommands[taskType]; !ok {
+		return nil
+	}
+
+	return &dmTask{taskType: taskType}
+}
+
+func dmTaskDestroy(task *dmTask) {
+}
+
+func dmTaskRun(task *dmTask) int {
+	task.errno = 0
+	task.exists = true
+
+	if err := task.run(); err != nil {
+		if errno, ok := err.(syscall.Errno); ok {
+			task.errno = int(errno)
+		} else {
+			task.errno = int(syscall.EIO)
+		}
+
+		return 0
+	}
+
+	return 1
+}
+
+func dmTaskSetName(task *dmTask, name string) int {
+	if len(name) >= dmNameLen {
+		return 0
+	}
+
+	task.name = name
+
+	return 1
+}
+
+func dmTaskSetNewName(task *dmTask, newname string) int {
+	if len(newname) >= dmNameLen {
+		return 0
+	}
+
+	task.newname = newname
+
+	return 1
+}
+
+func dmTaskSetMessage(task *dmTask, message string) int {
+	task.message = message
+
+	return 1
+}
+
+func dmTaskSetSector(task *dmTask, sector uint64) int {
+	task.sector = sector
+
+	return 1
+}
+
+func dmTaskSetCookie(task *dmTask, cookie *uint, flags uint16) int {
+	// There is no udev synchronization here, nodes are handled by syncNode
+	*cookie = 0
+
+	return 1
+}
+
+func dmTaskSetAddNode(task *dmTask, nodeType int) int {
+	return 1
+}
+
+func dmTaskSetRo(task *dmTask) int {
+	task.readonly = true
+
+	return 1
+}
+
+func dmTaskDeferredRemove(task *dmTask) int {
+	if task.taskType != deviceRemove {
+		return 0
+	}
+
+	task.deferred = true
+
+	return 1
+}
+
+func dmTaskGetErrno(task *dmTask) int {
+	return task.errno
+}
+
+func dmTaskAddTarget(task *dmTask, start, size uint64, ttype, params string) int {
+	if len(ttype) >= dmMaxTypeName {
+		return 0
+	}
+
+	task.targets = append(task.targets, dmTarget{start, size, ttype, params})
+
+	return 1
+}
+
+func dmTaskGetDeps(task *dmTask) *DmDeps {
+	if len(task.data) < 8 {
+		return nil
+	}
+
+	deps := &DmDeps{
+		Count:  nativeEndian.Uint32(task.data[0:]),
+		Filler: nativeEndian.Uint32(task.data[4:]),
+	}
+	for i := uint32(0); i < deps.Count && int(8+i*8+8) <= len(task.data); i++ {
+		deps.Device = append(deps.Device, nativeEndian.Uint64(task.data[8+i*8:]))
+	}
+
+	return deps
+}
+
+func dmTaskGetNames(task *dmTask) []string {
+	// struct dm_name_list is a chain of { dev, next, name } entries
+	if len(task.data) < 12 || nativeEndian.Uint64(task.data[0:]) == 0 {
+		return nil
+	}
+
+	names := []string{}
+	for offset := uint32(0); int(offset)+12 <= len(task.data); {
+		names = append(names, getCString(task.data[offset+12:]))
+
+		next := nativeEndian.Uint32(task.data[offset+8:])
+		if next == 0 {
+			break
+		}
+
+		offset += next
+	}
+
+	return names
+}
+
+func dmTaskGetInfo(task *dmTask, info *DmInfo) int {
+	*info = DmInfo{}
+
+	if !task.exists {
+		return 1
+	}
+
+	header := &task.header
+	dev := header.Dev
+
+	info.Exists = 1
+	info.Suspended = getFlag(header.Flags, dmSuspendFlag)
+	info.LiveTable = getFlag(header.Flags, dmActivePresentFlag)
+	info.InactiveTable = getFlag(header.Flags, dmInactivePresentFlag)
+	info.OpenCount = header.OpenCount
+	info.EventNr = header.EventNr
+	// The kernel hands out huge_encode_dev() numbers
+	info.Major = uint32((dev & 0xfff00) >> 8)
+	info.Minor = uint32((dev & 0xff) | ((dev >> 12) & 0xfff00))
+	info.ReadOnly = getFlag(header.Flags, dmReadonlyFlag)
+	info.TargetCount = int32(header.TargetCount)
+	info.DeferredRemove = getFlag(header.Flags, dmDeferredRemoveFlag)
+
+	return 1
+}
+
+func getFlag(flags, flag uint32) int {
+	if flags&flag != 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func dmTaskGetDriverVersion(task *dmTask) string {
+	version := task.header.Version
+
+	return fmt.Sprintf("%d.%d.%d", version[0], version[1], version[2])
+}
+
+func dmGetNextTarget(task *dmTask, next unsafe.Pointer, start, length *uint64, target, params *string) unsafe.Pointer {
+	// next points to the index of the target to return, nil means the first one
+	index := uint32(0)
+	if next != nil {
+		index = *(*uint32)(next)
+	}
+
+	*start, *length, *target, *params = 0, 0, "", ""
+
+	offset := uint32(0)
+	for i := uint32(0); i < index; i++ {
+		if int(offset)+dmTargetSpecSize > len(task.data) {
+			return nil
+		}
+
+		offset = nativeEndian.Uint32(task.data[offset+20:])
+	}
+
+	if index >= task.header.TargetCount || int(offset)+dmTargetSpecSize > len(task.data) {
+		return nil
+	}
+
+	spec := dmTargetSpec{}
+	if err := binary.Read(bytes.NewReader(task.data[offset:offset+dmTargetSpecSize]), nativeEndian, &spec); err != nil {
+		return nil
+	}
+
+	*start = spec.SectorStart
+	*length = spec.Length
+	*target = getCString(spec.TargetType[:])
+	*params = getCString(task.data[offset+dmTargetSpecSize:])
+
+	if index+1 >= task.header.TargetCount {
+		return nil
+	}
+
+	following := new(uint32)
+	*following = index + 1
+
+	return unsafe.Pointer(following)
+}
+
+func dmUdevSetSyncSupport(syncWithUdev int) {
+}
+
+func dmUdevGetSyncSupport() int {
+	return 0
+}
+
+func dmUdevWait(cookie uint) int {
+	return 1
+}
+
+func dmCookieSupported() int {
+	return 0
+}
+
+func dmSetDevDir(dir string) int {
+	return 1
+}
+
+func dmGetLibraryVersion(version *string) int {
+	*version = "native"
+
+	return 1
+}
@@ -0,0 +1,123 @@
+//go:build dmnative
+// +build dmnative
+
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+func TestDmIoctlSize(t *testing.T) {
+	// The kernel rejects headers and specs that do not match linux/dm-ioctl.h
+	if size := binary.Size(dmIoctl{}); size != dmIoctlSize {
+		t.Errorf("dm_ioctl is %v bytes, expected %v", size, dmIoctlSize)
+	}
+	if size := binary.Size(dmTargetSpec{}); size != dmTargetSpecSize {
+		t.Errorf("dm_target_spec is %v bytes, expected %v", size, dmTargetSpecSize)
+	}
+}
+
+func TestTablePayload(t *testing.T) {
+	targets := []dmTarget{
+		{0, 2048, "linear", "/dev/sda 0"},
+		{2048, 4096, "linear", "/dev/sdb 8192"},
+		{6144, 1024, "crypt", "aes-xts-plain64 :64:logon:overlit:layer 0 /dev/mapper/overlit-layer-base 0"},
+		{7168, 8, "zero", ""},
+	}
+
+	task := &dmTask{targets: targets}
+	payload := task.getPayload(deviceReload)
+
+	// Loaded specs point to the next one relative to themselves, reported ones from the start of the data
+	offset := uint32(0)
+	for range targets {
+		if offset%8 != 0 {
+			t.Fatalf("target spec at %v is not aligned", offset)
+		}
+
+		next := offset + nativeEndian.Uint32(payload[offset+20:])
+		nativeEndian.PutUint32(payload[offset+20:], next)
+
+		offset = next
+	}
+	if int(offset) != len(payload) {
+		t.Fatalf("target specs end at %v, payload has %v bytes", offset, len(payload))
+	}
+
+	reported := &dmTask{header: dmIoctl{TargetCount: uint32(len(targets))}, data: payload}
+
+	parsed := []dmTarget{}
+
+	var next unsafe.Pointer
+	for {
+		target := dmTarget{}
+
+		next = dmGetNextTarget(reported, next, &target.start, &target.size, &target.ttype, &target.params)
+		if target.ttype != "" {
+			parsed = append(parsed, target)
+		}
+		if next == nil {
+			break
+		}
+	}
+
+	if !reflect.DeepEqual(parsed, targets) {
+		t.Fatalf("parsed %v, expected %v", parsed, targets)
+	}
+}
+
+func TestTaskGetNames(t *testing.T) {
+	names := []string{"overlit-pool", "overlit-layer", "other"}
+
+	// struct dm_name_list entries are aligned to 8 bytes and point to the next one relative to themselves
+	data := []byte{}
+	for i, name := range names {
+		size := (12 + len(name) + 1 + 7) &^ 7
+
+		entry := make([]byte, size)
+		nativeEndian.PutUint64(entry[0:], uint64(0xfd00+i))
+		if i+1 < len(names) {
+			nativeEndian.PutUint32(entry[8:], uint32(size))
+		}
+		copy(entry[12:], name)
+
+		data = append(data, entry...)
+	}
+
+	if parsed := dmTaskGetNames(&dmTask{data: data}); !reflect.DeepEqual(parsed, names) {
+		t.Fatalf("parsed %v, expected %v", parsed, names)
+	}
+
+	// A list without devices has a zero dev in its first entry
+	if parsed := dmTaskGetNames(&dmTask{data: make([]byte, 16)}); len(parsed) != 0 {
+		t.Fatalf("parsed %v from an empty list", parsed)
+	}
+}
+
+func TestTaskGetInfo(t *testing.T) {
+	major, minor := uint64(253), uint64(0x12345)
+
+	// huge_encode_dev() keeps the low minor byte at the bottom and moves the rest above the major
+	dev := (minor & 0xff) | (major << 8) | ((minor &^ 0xff) << 12)
+
+	task := &dmTask{exists: true, header: dmIoctl{Dev: dev, OpenCount: 2, Flags: dmActivePresentFlag | dmDeferredRemoveFlag}}
+
+	info := &DmInfo{}
+	if dmTaskGetInfo(task, info) == 0 {
+		t.Fatal("could not get info")
+	}
+
+	if uint64(info.Major) != major || uint64(info.Minor) != minor {
+		t.Errorf("decoded %v:%v, expected %v:%v", info.Major, info.Minor, major, minor)
+	}
+	if info.Exists != 1 || info.LiveTable != 1 || info.DeferredRemove != 1 || info.Suspended != 0 || info.OpenCount != 2 {
+		t.Errorf("decoded %+v", info)
+	}
+
+	if dmTaskGetInfo(&dmTask{}, info) == 0 || info.Exists != 0 {
+		t.Errorf("missing device decoded as %+v", info)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type DmFragmentation struct {
+	FreeExtents uint64
+	FreeRuns    uint64
+	LargestRun  uint64
+	Targets     uint64
+	Fragmented  uint64
+}
+
+func (f DmFragmentation) String() string {
+	return fmt.Sprintf("free extents = %v, free runs = %v, largest free run = %v, targets = %v, fragmented devices = %v", f.FreeExtents, f.FreeRuns, f.LargestRun, f.Targets, f.Fragmented)
+}
+
+func (d *DmTool) GetFragmentation() DmFragmentation {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f := DmFragmentation{}
+
+	for _, run := range d.getFreeRuns() {
+		f.FreeExtents += run.Count
+		f.FreeRuns++
+		f.LargestRun = getMaxUint64(f.LargestRun, run.Count)
+	}
+
+	// Adjacent targets are one run on disk, so only gaps count as fragmentation
+	for _, device := range d.Devices {
+		targets := d.coalesceTargets(device.Targets)
+
+		f.Targets += uint64(len(targets))
+
+		if len(targets) > 1 {
+			f.Fragmented++
+		}
+	}
+
+	return f
+}
+
+func (d *DmTool) coalesceTargets(targets []DmExtentRun) []DmExtentRun {
+	merged := []DmExtentRun{}
+
+	for _, target := range targets {
+		if len(merged) > 0 {
+			prev := &merged[len(merged)-1]
+
+			if prev.Device == target.Device && prev.Start+prev.Count == target.Start {
+				prev.Count += target.Count
+				continue
+			}
+		}
+
+		merged = append(merged, target)
+	}
+
+	return merged
+}
+
+func (d *DmTool) copyExtents(devpaths []string, dst DmExtentRun, src DmExtentRun) error {
+	r, err := os.OpenFile(devpaths[src.Device], os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(devpaths[dst.Device], os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	// Drop cached pages of the backing device so we copy what the device wrote
+	unix.Fadvise(int(r.Fd()), 0, 0, unix.FADV_DONTNEED)
+
+	buf := make([]byte, d.ExtentSize)
+
+	for i := uint64(0); i < src.Count; i++ {
+		if _, err := r.ReadAt(buf, int64((src.Start+i)*d.ExtentSize)); err != nil {
+			return err
+		}
+		if _, err := w.WriteAt(buf, int64((dst.Start+i)*d.ExtentSize)); err != nil {
+			return err
+		}
+	}
+
+	return w.Sync()
+}
+
+func (device *DmDevice) isWritable() bool {
+	// Caches write back into the base even below a read-only filesystem
+	return !device.Readonly || device.FsType == "" || device.CacheMode != ""
+}
+
+func (d *DmTool) moveDevice(name string, device *DmDevice, run DmExtentRun, devpaths []string, table []dmTarget) error {
+	d.mu.Lock()
+	base := d.getDeviceStack(name, device)[0]
+	d.mu.Unlock()
+
+	// Nobody has a writable device open here, suspending only keeps late openers out during the copy
+	quiet := device.isWritable()
+	if quiet {
+		if err := d.suspendDevice(base.name); err != nil {
+			return err
+		}
+	}
+
+	offset := run.Start
+
+	for _, target := range device.Targets {
+		if err := d.copyExtents(devpaths, DmExtentRun{run.Device, offset, target.Count}, target); err != nil {
+			if quiet {
+				d.resumeDevice(base.name)
+			}
+			return err
+		}
+
+		offset += target.Count
+	}
+
+	// Only the base of a stacked device maps the extents and loading the new table resumes it
+	if err := d.activateDevice(base.name, table, device.Sealed && !base.writable); err != nil {
+		if quiet {
+			d.resumeDevice(base.name)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (d *DmTool) coalesceDevice(name string, device *DmDevice) error {
+	d.mu.Lock()
+	targets := d.coalesceTargets(device.Targets)
+	if len(targets) == len(device.Targets) {
+		d.mu.Unlock()
+		return nil
+	}
+
+	otargets := device.Targets
+
+	device.Targets = targets
+
+	layer := d.getDeviceStack(name, device)[0]
+	d.mu.Unlock()
+
+	if err := d.activateDevice(layer.name, layer.table, device.Sealed && !layer.writable); err != nil {
+		d.mu.Lock()
+		device.Targets = otargets
+		d.mu.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+func (d *DmTool) defragDevice(name string) error {
+	d.locker.Lock(name)
+	defer d.locker.Unlock(name)
+
+	d.mu.Lock()
+	device, ok := d.Devices[name]
+	d.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	// Reclaiming devices are detached already and removing ones still belong to the kernel
+	if device.Removing || device.Reclaiming {
+		return nil
+	}
+
+	if err := d.coalesceDevice(name, device); err != nil {
+		return err
+	}
+
+	if len(device.Targets) <= 1 {
+		return nil
+	}
+
+	// Writers of a device in use would stall for the whole copy, so it waits for the next defrag
+	if device.isWritable() {
+		d.mu.Lock()
+		stack := d.getDeviceStack(name, device)
+		d.mu.Unlock()
+
+		if d.getOpenCount(stack[len(stack)-1].name) > 0 {
+			log.Printf("overlit: skip defrag of busy %v device\n", name)
+			return nil
+		}
+	}
+
+	d.mu.Lock()
+	run, found := d.policy.FindRun(d.getFreeRuns(), device.Extents, device.Readonly)
+	if !found || run.Count < device.Extents {
+		d.mu.Unlock()
+		return nil
+	}
+
+	log.Printf("overlit: defrag (device = %v, targets = %v, extents = %v, start = %v)\n", name, len(device.Targets), device.Extents, run.Start)
+
+	// Reserve the run so nobody else allocates it while the data is copied
+	d.setExtents(run)
+	d.reserveExtents(run)
+
+	devpaths := d.DevPaths
+	table := d.getLinearTargets([]DmExtentRun{run})
+	d.mu.Unlock()
+
+	err := d.moveDevice(name, device, run, devpaths, table)
+
+	d.mu.Lock()
+
+	d.unreserveExtents(run)
+
+	if err != nil {
+		d.clearExtents(run)
+		d.mu.Unlock()
+		return err
+	}
+
+	before := device.clone()
+
+	for _, target := range device.Targets {
+		d.clearExtents(target)
+	}
+
+	device.Targets = []DmExtentRun{run}
+	device.ExtentStart = run.Start
+	device.ExtentCount = run.Count
+
+	// The old extents are free from here on, so the new placement has to outlive a crash
+	err = d.logJournal("move", name, before, device)
+	d.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return d.syncJournal()
+}
+
+func (d *DmTool) Defrag() (DmFragmentation, DmFragmentation, error) {
+	before := d.GetFragmentation()
+
+	if d.Allocator != linearAllocator {
+		return before, before, errors.Errorf("not supported defrag for %v allocator", d.Allocator)
+	}
+
+	d.mu.Lock()
+	names := []string{}
+	for name := range d.Devices {
+		names = append(names, name)
+	}
+	d.mu.Unlock()
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := d.defragDevice(name); err != nil {
+			return before, d.GetFragmentation(), errors.Wrapf(err, "could not move %v device", name)
+		}
+	}
+
+	return before, d.GetFragmentation(), d.Flush()
+}
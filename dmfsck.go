@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unsafe"
+
+	"github.com/willf/bitset"
+)
+
+const (
+	fsckOff    = "off"
+	fsckCheck  = "check"
+	fsckRepair = "repair"
+)
+
+type DmProblem struct {
+	Name     string
+	Problem  string
+	Repaired bool
+}
+
+func (p DmProblem) String() string {
+	if p.Repaired {
+		return fmt.Sprintf("%v: %v (repaired)", p.Name, p.Problem)
+	}
+
+	return fmt.Sprintf("%v: %v", p.Name, p.Problem)
+}
+
+func (d *DmTool) listDevices() ([]string, error) {
+	task, err := d.createTask(deviceList, "list", "")
+	if err != nil {
+		return nil, err
+	}
+	defer dmTaskDestroy(task)
+
+	if err := d.runTask(task, "list", ""); err != nil {
+		return nil, err
+	}
+
+	// Devices without our prefix belong to other device-mapper users
+	names := []string{}
+	for _, dmname := range dmTaskGetNames(task) {
+		if strings.HasPrefix(dmname, d.Prefix) {
+			names = append(names, strings.TrimPrefix(dmname, d.Prefix))
+		}
+	}
+
+	return names, nil
+}
+
+func (d *DmTool) getTable(devname string) ([]dmTarget, error) {
+	task, err := d.createTask(deviceTable, "table", devname)
+	if err != nil {
+		return nil, err
+	}
+	defer dmTaskDestroy(task)
+
+	if err := d.runTask(task, "table", devname); err != nil {
+		return nil, err
+	}
+
+	targets := []dmTarget{}
+
+	var next unsafe.Pointer
+
+	for {
+		target := dmTarget{}
+
+		next = dmGetNextTarget(task, next, &target.start, &target.size, &target.ttype, &target.params)
+		if target.ttype != "" {
+			targets = append(targets, target)
+		}
+		if next == nil {
+			break
+		}
+	}
+
+	return targets, nil
+}
+
+func (d *DmTool) getOpenCount(devname string) int32 {
+	return d.infoDevice(devname).OpenCount
+}
+
+func (d *DmTool) normalizeTable(table []dmTarget) []dmTarget {
+	// The kernel reports the devices of a table by their numbers
+	normalized := []dmTarget{}
+
+	for _, target := range table {
+		fields := strings.Fields(target.params)
+		for i, field := range fields {
+			if strings.HasPrefix(field, "/") {
+				fields[i] = getDeviceNumber(field)
+			}
+		}
+		target.params = strings.Join(fields, " ")
+
+		normalized = append(normalized, target)
+	}
+
+	return normalized
+}
+
+func (d *DmTool) isEqualTable(a, b []dmTarget) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !d.isEqualTarget(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (d *DmTool) isOwnTable(table []dmTarget) bool {
+	numbers := map[string]bool{getDeviceNumber(d.getPoolPath()): true}
+	if d.CachePath != "" {
+		numbers[getDeviceNumber(d.CachePath)] = true
+	}
+	for _, devpath := range d.DevPaths {
+		numbers[getDeviceNumber(devpath)] = true
+	}
+
+	for _, target := range table {
+		for _, field := range strings.Fields(target.params) {
+			if numbers[field] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (d *DmTool) fsckDevice(name string, kernel bool, repair bool) []DmProblem {
+	d.locker.Lock(name)
+	defer d.locker.Unlock(name)
+
+	problems := []DmProblem{}
+
+	// Kernel calls go without mu, the device lock alone keeps this device from changing
+	d.mu.Lock()
+	device, ok := d.Devices[name]
+
+	var stack []dmLayer
+	if ok && !device.Removing && !device.Reclaiming {
+		stack = d.getDeviceStack(name, device)
+	}
+	d.mu.Unlock()
+
+	if !ok && kernel {
+		table, err := d.getTable(name)
+		if err != nil {
+			return problems
+		}
+
+		d.mu.Lock()
+		own := d.isOwnTable(table)
+		d.mu.Unlock()
+		if !own {
+			return problems
+		}
+
+		problem := DmProblem{Name: name, Problem: "device is not recorded in json config"}
+
+		// Only idle devices can go, an open one is still used by somebody
+		if repair && d.getOpenCount(name) == 0 {
+			problem.Repaired = d.detachDevice(name) == nil
+		}
+
+		return append(problems, problem)
+	}
+
+	// Devices on their way out lose their layers one by one, so they have no stack to check
+	for _, layer := range stack {
+		if d.checkDevice(layer.name) == 0 {
+			problem := DmProblem{Name: layer.name, Problem: "device is missing in kernel"}
+
+			if repair {
+				problem.Repaired = d.ensureDevice(layer.name) == nil && d.activateDevice(layer.name, layer.table, device.Sealed && !layer.writable) == nil
+			}
+
+			problems = append(problems, problem)
+			continue
+		}
+
+		table, err := d.getTable(layer.name)
+		if err != nil {
+			problems = append(problems, DmProblem{Name: layer.name, Problem: fmt.Sprintf("could not get table: %v", err)})
+			continue
+		}
+
+		if !d.isEqualTable(d.normalizeTable(layer.table), table) {
+			problem := DmProblem{Name: layer.name, Problem: fmt.Sprintf("table mismatch (kernel = %v targets, json = %v targets)", len(table), len(layer.table))}
+
+			if repair {
+				problem.Repaired = d.activateDevice(layer.name, layer.table, device.Sealed && !layer.writable) == nil
+			}
+
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems
+}
+
+func (d *DmTool) fsckExtents(repair bool) []DmProblem {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	problems := []DmProblem{}
+
+	// Thin pools own every extent, their devices have no targets of their own
+	if d.Allocator != linearAllocator {
+		return problems
+	}
+
+	owned := []*bitset.BitSet{}
+	for _, backing := range d.backings {
+		owned = append(owned, bitset.New(uint(backing.extents)))
+	}
+
+	names := []string{}
+	for name := range d.Devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	overlapped := false
+
+	for _, name := range names {
+		device := d.Devices[name]
+
+		for _, target := range device.getAllTargets() {
+			if target.Device >= len(d.backings) || target.Start+target.Count > d.backings[target.Device].extents {
+				problems = append(problems, DmProblem{Name: name, Problem: fmt.Sprintf("target is out of backing device (device = %v, start = %v, count = %v)", target.Device, target.Start, target.Count)})
+				overlapped = true
+				continue
+			}
+
+			doubled := uint64(0)
+
+			for i := uint64(0); i < target.Count; i++ {
+				if owned[target.Device].Test(uint(target.Start + i + 1)) {
+					doubled++
+				}
+
+				owned[target.Device].Set(uint(target.Start + i + 1))
+			}
+
+			if doubled > 0 {
+				problems = append(problems, DmProblem{Name: name, Problem: fmt.Sprintf("%v extents are booked by another device (device = %v, start = %v, count = %v)", doubled, target.Device, target.Start, target.Count)})
+				overlapped = true
+			}
+		}
+	}
+
+	// Extents of operations in flight are owned once they finish, so the bitmap has to keep them
+	for target := range d.reserved {
+		if target.Device >= len(d.backings) {
+			continue
+		}
+
+		for i := uint64(0); i < target.Count; i++ {
+			owned[target.Device].Set(uint(target.Start + i + 1))
+		}
+	}
+
+	for device, backing := range d.backings {
+		leaked := uint64(0)
+		unreserved := uint64(0)
+
+		for extent := uint64(0); extent < backing.extents; extent++ {
+			used := owned[device].Test(uint(extent + 1))
+			free := d.isFreeExtent(device, extent)
+
+			if !used && !free {
+				leaked++
+			} else if used && free {
+				unreserved++
+			}
+		}
+
+		if leaked == 0 && unreserved == 0 {
+			continue
+		}
+
+		problem := DmProblem{Name: d.DevPaths[device], Problem: fmt.Sprintf("extent bitmap mismatch (leaked = %v, unreserved = %v)", leaked, unreserved)}
+
+		// Rebuilding the bitmap is only safe while no extent has two owners
+		if repair && !overlapped {
+			backing.extentbits = owned[device]
+			problem.Repaired = true
+		}
+
+		problems = append(problems, problem)
+	}
+
+	return problems
+}
+
+func (d *DmTool) Fsck(repair bool) ([]DmProblem, error) {
+	kernels, err := d.listDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	names := map[string]bool{}
+	for name := range d.Devices {
+		names[name] = false
+	}
+
+	for _, name := range kernels {
+		if name == thinPoolName || name == thinMetaName || name == thinDataName || d.isStackDevice(name) {
+			continue
+		}
+
+		names[name] = true
+	}
+	d.mu.Unlock()
+
+	sorted := []string{}
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	problems := []DmProblem{}
+
+	for _, name := range sorted {
+		problems = append(problems, d.fsckDevice(name, names[name], repair)...)
+	}
+
+	problems = append(problems, d.fsckExtents(repair)...)
+
+	return problems, nil
+}
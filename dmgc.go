@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+func (d *DmTool) GetOrphanDevices() ([]string, error) {
+	kernels, err := d.listDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := []string{}
+
+	for _, name := range kernels {
+		if d.isOrphanDevice(name) {
+			orphans = append(orphans, name)
+		}
+	}
+
+	return orphans, nil
+}
+
+func (d *DmTool) isRecordedDevice(name string) bool {
+	if name == thinPoolName || name == thinMetaName || name == thinDataName {
+		return true
+	}
+	if _, ok := d.Devices[name]; ok {
+		return true
+	}
+
+	return d.isStackDevice(name)
+}
+
+func (d *DmTool) isOrphanDevice(name string) bool {
+	// Records are checked under mu and the kernel is asked without it
+	d.mu.Lock()
+	recorded := d.isRecordedDevice(name)
+	d.mu.Unlock()
+
+	if recorded {
+		return false
+	}
+
+	table, err := d.getTable(name)
+	if err != nil {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// A device that never got extents still has the placeholder table of attachDevice
+	return d.isOwnTable(table) || d.isEqualTable(table, []dmTarget{{0, 1, "zero", ""}})
+}
+
+func (d *DmTool) RemoveOrphanDevice(name string) error {
+	// The device lock keeps CreateDevice from taking the name in the meantime
+	d.locker.Lock(name)
+	defer d.locker.Unlock(name)
+
+	if !d.isOrphanDevice(name) {
+		return errors.Errorf("%v device is not orphaned", name)
+	}
+
+	if d.getOpenCount(name) > 0 {
+		return errors.Errorf("%v device is busy", name)
+	}
+
+	return d.detachDevice(name)
+}
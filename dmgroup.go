@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Groups are quotas of tenants within one pool, Setup refuses a backing device locked by another instance
+type DmGroup struct {
+	Quota uint64 `json:"quota"`
+}
+
+func (d *DmTool) getGroup(group string) *DmGroup {
+	if _, ok := d.Groups[group]; !ok {
+		d.Groups[group] = &DmGroup{}
+	}
+
+	return d.Groups[group]
+}
+
+func (d *DmTool) checkGroupQuota(device *DmDevice, extents uint64) error {
+	if extents <= device.Extents {
+		return nil
+	}
+
+	group := d.getGroup(device.Group)
+	if group.Quota == 0 {
+		return nil
+	}
+
+	used := d.getGroupUsage(device.Group)
+	if used-device.Extents*d.ExtentSize+extents*d.ExtentSize > group.Quota {
+		return errors.Errorf("%v group quota is exhausted (used = %v, quota = %v)", device.Group, used, group.Quota)
+	}
+
+	return nil
+}
+
+func (d *DmTool) getGroupUsage(group string) uint64 {
+	extents := uint64(0)
+
+	for _, device := range d.Devices {
+		if device.Group == group {
+			extents += device.getUsedExtents()
+		}
+	}
+
+	return extents * d.ExtentSize
+}
+
+func (d *DmTool) GetGroups() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	groups := []string{}
+	for group := range d.Groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	return groups
+}
+
+func (d *DmTool) SetGroupQuota(group string, quota uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Groups other than the default one come to exist only here
+	d.getGroup(group).Quota = quota
+
+	return nil
+}
+
+func (d *DmTool) GetGroupQuota(group string) (uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if group, ok := d.Groups[group]; ok {
+		return group.Quota, nil
+	}
+
+	return 0, errors.Errorf("has no %v group", group)
+}
+
+func (d *DmTool) GetGroupUsage(group string) (uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.Groups[group]; !ok {
+		return 0, errors.Errorf("has no %v group", group)
+	}
+
+	return d.getGroupUsage(group), nil
+}
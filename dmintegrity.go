@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	integrityJournalSectors = 8192
+	integritySlackSectors   = 2048
+)
+
+var integrityTagSizes = map[string]uint64{
+	"crc32c": 4,
+	"crc32":  4,
+	"sha1":   20,
+	"sha256": 32,
+}
+
+func getIntegrityTagSize(algorithm string) (uint64, error) {
+	if size, ok := integrityTagSizes[algorithm]; ok {
+		return size, nil
+	}
+
+	return 0, errors.Errorf("not supported %v integrity algorithm", algorithm)
+}
+
+func (d *DmTool) getIntegrityMetaExtents(device *DmDevice, extents uint64) uint64 {
+	tagsize, _ := getIntegrityTagSize(device.Integrity)
+	datasectors := extents * d.ExtentSize / 512
+
+	// Tags of every data sector, the journal and the superblock all live on the metadata device
+	sectors := datasectors*tagsize/512 + integrityJournalSectors + integritySlackSectors
+
+	return (sectors*512 + d.ExtentSize - 1) / d.ExtentSize
+}
+
+func (d *DmTool) getIntegrityTable(device *DmDevice, datapath, metapath string) []dmTarget {
+	multis := uint64(d.ExtentSize / 512)
+	tagsize, _ := getIntegrityTagSize(device.Integrity)
+
+	// Recalculation tags the sectors nobody wrote yet, so reading them is no error
+	return []dmTarget{
+		{0, device.Extents * multis, "integrity", fmt.Sprintf("%v 0 %v J 4 meta_device:%v internal_hash:%v journal_sectors:%v recalculate", datapath, tagsize, metapath, device.Integrity, integrityJournalSectors)},
+	}
+}
+
+func (d *DmTool) isEqualTarget(a, b dmTarget) bool {
+	if a.ttype != "integrity" || b.ttype != "integrity" {
+		return a == b
+	}
+
+	// The kernel reports every integrity argument, so only the fixed ones are compared
+	afields := strings.Fields(a.params)
+	bfields := strings.Fields(b.params)
+	if len(afields) < 4 || len(bfields) < 4 {
+		return a == b
+	}
+
+	return a.start == b.start && a.size == b.size && strings.Join(afields[:4], " ") == strings.Join(bfields[:4], " ")
+}
+
+func (d *DmTool) wipeSuperblock(targets []DmExtentRun) error {
+	if len(targets) == 0 {
+		return nil
+	}
+
+	target := targets[0]
+
+	f, err := os.OpenFile(d.DevPaths[target.Device], os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// dm-integrity only formats a metadata device that starts with a zeroed superblock
+	if _, err := f.WriteAt(make([]byte, 4096), int64(target.Start*d.ExtentSize)); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
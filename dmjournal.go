@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	journalSuffix = ".journal"
+)
+
+type dmJournalRecord struct {
+	Seq    uint64    `json:"seq"`
+	Op     string    `json:"op,omitempty"`
+	Name   string    `json:"name,omitempty"`
+	Before *DmDevice `json:"before,omitempty"`
+	After  *DmDevice `json:"after,omitempty"`
+	Commit bool      `json:"commit,omitempty"`
+}
+
+func (device *DmDevice) clone() *DmDevice {
+	if device == nil {
+		return nil
+	}
+
+	// Every slice is copied, so later changes in place can not reach the image of a record
+	c := *device
+	c.Targets = append([]DmExtentRun{}, device.Targets...)
+	c.HashTargets = cloneExtentRuns(device.HashTargets)
+	c.MetaTargets = cloneExtentRuns(device.MetaTargets)
+	c.CacheTargets = cloneExtentRuns(device.CacheTargets)
+
+	return &c
+}
+
+func cloneExtentRuns(runs []DmExtentRun) []DmExtentRun {
+	if runs == nil {
+		return nil
+	}
+
+	return append([]DmExtentRun{}, runs...)
+}
+
+func (d *DmTool) getJournalPath() string {
+	return strings.TrimSuffix(d.jsonpath, filepath.Ext(d.jsonpath)) + journalSuffix
+}
+
+func (d *DmTool) openJournal() error {
+	f, err := os.OpenFile(d.getJournalPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not open journal")
+	}
+
+	d.journal = f
+	d.journalbuf = &bytes.Buffer{}
+	d.pending = make(map[uint64]dmJournalRecord)
+
+	return nil
+}
+
+func (d *DmTool) closeJournal() {
+	d.jmu.Lock()
+	defer d.jmu.Unlock()
+
+	if d.journal != nil {
+		d.journal.Close()
+		d.journal = nil
+	}
+}
+
+func encodeJournal(buf *bytes.Buffer, records ...dmJournalRecord) error {
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return errors.New("could not encode journal record")
+		}
+
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	return nil
+}
+
+func (d *DmTool) writeJournal(records ...dmJournalRecord) error {
+	if d.journalbuf == nil {
+		return nil
+	}
+
+	return encodeJournal(d.journalbuf, records...)
+}
+
+func (d *DmTool) takeJournal() []byte {
+	if d.journalbuf == nil || d.journalbuf.Len() == 0 {
+		return nil
+	}
+
+	data := append([]byte{}, d.journalbuf.Bytes()...)
+	d.journalbuf.Reset()
+
+	return data
+}
+
+func (d *DmTool) appendJournal(data []byte) error {
+	if d.journal == nil || len(data) == 0 {
+		return nil
+	}
+
+	if _, err := d.journal.Write(data); err != nil {
+		return errors.Wrap(err, "could not write journal")
+	}
+
+	return d.journal.Sync()
+}
+
+func (d *DmTool) syncJournal() error {
+	// Whoever took buffered records wrote and synced them before releasing jmu
+	d.jmu.Lock()
+	defer d.jmu.Unlock()
+
+	d.mu.Lock()
+	data := d.takeJournal()
+	d.mu.Unlock()
+
+	return d.appendJournal(data)
+}
+
+func (d *DmTool) beginJournal(op, name string, before, after *DmDevice) (uint64, error) {
+	d.journalseq++
+
+	record := dmJournalRecord{Seq: d.journalseq, Op: op, Name: name, Before: before.clone(), After: after.clone()}
+
+	if err := d.writeJournal(record); err != nil {
+		return 0, err
+	}
+
+	if d.pending != nil {
+		d.pending[record.Seq] = record
+	}
+
+	return record.Seq, nil
+}
+
+func (d *DmTool) commitJournal(seq uint64) error {
+	delete(d.pending, seq)
+
+	return d.writeJournal(dmJournalRecord{Seq: seq, Commit: true})
+}
+
+func (d *DmTool) abortJournal(seq uint64) {
+	// Nothing is written, replay rolls an uncommitted record back anyway
+	delete(d.pending, seq)
+}
+
+func (d *DmTool) logJournal(op, name string, before, after *DmDevice) error {
+	d.journalseq++
+
+	return d.writeJournal(dmJournalRecord{Seq: d.journalseq, Op: op, Name: name, Before: before.clone(), After: after.clone(), Commit: true})
+}
+
+func (d *DmTool) getPendingRecords() []dmJournalRecord {
+	seqs := []uint64{}
+	for seq := range d.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	records := []dmJournalRecord{}
+	for _, seq := range seqs {
+		records = append(records, d.pending[seq])
+	}
+
+	return records
+}
+
+func (d *DmTool) truncateJournal(pending []dmJournalRecord) error {
+	if d.journal == nil {
+		return nil
+	}
+
+	// Operations still in flight have to survive the truncation
+	buf := &bytes.Buffer{}
+	if err := encodeJournal(buf, pending...); err != nil {
+		return err
+	}
+
+	tmpfile, err := ioutil.TempFile(filepath.Dir(d.jsonpath), ".tmp")
+	if err != nil {
+		return errors.New("could not create temp file for journal")
+	}
+
+	if _, err := tmpfile.Write(buf.Bytes()); err != nil {
+		tmpfile.Close()
+		return errors.New("could not write journal to temp file")
+	}
+	if err := tmpfile.Sync(); err != nil {
+		tmpfile.Close()
+		return errors.New("could not sync temp file")
+	}
+	if err := tmpfile.Close(); err != nil {
+		return errors.New("could not close temp file")
+	}
+	if err := os.Rename(tmpfile.Name(), d.getJournalPath()); err != nil {
+		return errors.New("could not truncate journal")
+	}
+
+	f, err := os.OpenFile(d.getJournalPath(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not open journal")
+	}
+
+	d.journal.Close()
+	d.journal = f
+
+	return nil
+}
+
+func (d *DmTool) readJournal() ([]dmJournalRecord, error) {
+	data, err := ioutil.ReadFile(d.getJournalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, errors.Wrap(err, "could not read journal")
+	}
+
+	records := []dmJournalRecord{}
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		record := dmJournalRecord{}
+
+		// A torn record at the tail was never synced, so its operation never went on
+		if err := json.Unmarshal(line, &record); err != nil {
+			log.Printf("overlit: skip torn journal record (%v)\n", err)
+			break
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (d *DmTool) replayJournal() (int, error) {
+	records, err := d.readJournal()
+	if err != nil {
+		return 0, err
+	}
+
+	committed := make(map[uint64]bool)
+	for _, record := range records {
+		if record.Commit {
+			committed[record.Seq] = true
+		}
+	}
+
+	undone := make(map[string]*DmDevice)
+	discarded := make(map[string]bool)
+	replayed := 0
+
+	for _, record := range records {
+		if record.Op == "" {
+			continue
+		}
+
+		d.journalseq = getMaxUint64(d.journalseq, record.Seq)
+
+		// Thin ids may have been handed to the pool before the crash, so never reuse them
+		for _, device := range []*DmDevice{record.Before, record.After} {
+			if device != nil {
+				d.ThinNextId = getMaxUint64(d.ThinNextId, device.ThinId)
+			}
+		}
+
+		device := record.After
+		if !committed[record.Seq] {
+			log.Printf("overlit: roll back journal record (seq = %v, op = %v, name = %v)\n", record.Seq, record.Op, record.Name)
+
+			device = record.Before
+
+			if record.Before == nil && record.After != nil {
+				undone[record.Name] = record.After
+			}
+		}
+
+		if device != nil {
+			d.Devices[record.Name] = device.clone()
+		} else {
+			delete(d.Devices, record.Name)
+		}
+
+		// Devices waiting for their extents to be wiped are deleted already
+		if device == nil || device.Reclaiming {
+			if (record.Before != nil && record.Before.Cipher != "") || (record.After != nil && record.After.Cipher != "") {
+				discarded[record.Name] = true
+			}
+		}
+
+		replayed++
+	}
+
+	// Creations that never committed may have left a kernel device or a thin id behind
+	for name, device := range undone {
+		if _, ok := d.Devices[name]; ok {
+			continue
+		}
+
+		if d.checkDevice(name) != 0 {
+			if err := d.detachDevice(name); err != nil {
+				log.Printf("overlit: failed to remove %v device: %v\n", name, err)
+			}
+		}
+
+		if device.ThinId != 0 && d.Allocator == thinAllocator {
+			if err := d.deleteThin(device); err != nil {
+				log.Printf("overlit: failed to delete %v thin device: %v\n", device.ThinId, err)
+			}
+		}
+	}
+
+	// Keys of deleted devices may have outlived them, unless the name was taken again
+	for name := range discarded {
+		if device, ok := d.Devices[name]; ok && !device.Reclaiming {
+			continue
+		}
+
+		if err := d.discardKey(name); err != nil {
+			log.Printf("overlit: failed to delete key of %v device: %v\n", name, err)
+		}
+	}
+
+	return replayed, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Version 1 packed each target as start<<8|count without a version field
+	// Version 2 had a single devpath and targets without a device index
+	dmToolVersion = 3
+)
+
+type migrateFunc func(config map[string]interface{}) error
+
+var migrateFuncs = map[int]migrateFunc{
+	1: migrateConfigV1,
+	2: migrateConfigV2,
+}
+
+func migrateConfigV1(config map[string]interface{}) error {
+	devices, _ := config["devices"].(map[string]interface{})
+
+	for devname, _device := range devices {
+		device, ok := _device.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("could not parse %v device", devname)
+		}
+
+		_targets, _ := device["targets"].([]interface{})
+		targets := []interface{}{}
+
+		for _, _target := range _targets {
+			number, ok := _target.(json.Number)
+			if !ok {
+				return errors.Errorf("could not parse targets of %v device", devname)
+			}
+
+			target, err := strconv.ParseUint(number.String(), 10, 64)
+			if err != nil {
+				return err
+			}
+
+			targets = append(targets, map[string]interface{}{
+				"start": target >> 8,
+				"count": target & 0xff,
+			})
+		}
+
+		device["targets"] = targets
+	}
+
+	return nil
+}
+
+func migrateConfigV2(config map[string]interface{}) error {
+	if devpath, ok := config["devpath"]; ok {
+		config["devpaths"] = []interface{}{devpath}
+
+		delete(config, "devpath")
+	}
+
+	devices, _ := config["devices"].(map[string]interface{})
+
+	for devname, _device := range devices {
+		device, ok := _device.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("could not parse %v device", devname)
+		}
+
+		targets, _ := device["targets"].([]interface{})
+
+		for _, _target := range targets {
+			target, ok := _target.(map[string]interface{})
+			if !ok {
+				return errors.Errorf("could not parse targets of %v device", devname)
+			}
+
+			target["device"] = 0
+		}
+	}
+
+	return nil
+}
+
+func migrateConfig(jsonpath string, jsondata []byte) ([]byte, bool, error) {
+	config := map[string]interface{}{}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsondata))
+	decoder.UseNumber()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, false, errors.New("could not parse json config")
+	}
+
+	version := 1
+	if number, ok := config["version"].(json.Number); ok {
+		if v, err := number.Int64(); err == nil {
+			version = int(v)
+		}
+	}
+
+	if version > dmToolVersion {
+		return nil, false, errors.Errorf("not supported json config version %v", version)
+	}
+	if version == dmToolVersion {
+		return jsondata, false, nil
+	}
+
+	backup := fmt.Sprintf("%v.v%v", jsonpath, version)
+	if err := ioutil.WriteFile(backup, jsondata, 0600); err != nil {
+		return nil, false, errors.Wrap(err, "could not backup json config")
+	}
+
+	log.Printf("overlit: migrate json config (version = %v -> %v, backup = %v)\n", version, dmToolVersion, backup)
+
+	for ; version < dmToolVersion; version++ {
+		if err := migrateFuncs[version](config); err != nil {
+			return nil, false, err
+		}
+	}
+
+	config["version"] = dmToolVersion
+
+	migrated, err := json.Marshal(config)
+	if err != nil {
+		return nil, false, errors.New("could not encode json config")
+	}
+
+	return migrated, true, nil
+}
+
+func (d *DmTool) hasDmDevice(dmname string) bool {
+	info := &DmInfo{}
+
+	task, err := d.createRawTask(deviceInfo, "info", dmname)
+	if err != nil {
+		return false
+	}
+	defer dmTaskDestroy(task)
+
+	if err := d.runTask(task, "info", dmname); err != nil {
+		return false
+	}
+	if dmTaskGetInfo(task, info) == 0 {
+		return false
+	}
+
+	return info.Exists != 0
+}
+
+func (d *DmTool) renameDevice(dmname, newname string) error {
+	var cookie uint
+
+	task, err := d.createRawTask(deviceRename, "rename", dmname)
+	if err != nil {
+		return err
+	}
+	defer dmTaskDestroy(task)
+
+	if dmTaskSetNewName(task, newname) == 0 {
+		return &DmError{Op: "rename", Name: dmname}
+	}
+	if d.setCookie(task, &cookie, 0) == 0 {
+		return &DmError{Op: "rename", Name: dmname}
+	}
+	defer dmUdevWait(cookie)
+
+	if err := d.runTask(task, "rename", dmname); err != nil {
+		return err
+	}
+
+	if err := d.syncNode(dmname); err != nil {
+		return err
+	}
+
+	return d.syncNode(newname)
+}
+
+func (d *DmTool) renameDevices(oprefix string) error {
+	// Configs without a prefix used raw layer ids and overlit- for the pool
+	candidates := map[string][]string{
+		thinPoolName: {oprefix + thinPoolName, legacyPoolPrefix + thinPoolName},
+		thinMetaName: {oprefix + thinMetaName, legacyPoolPrefix + thinMetaName},
+		thinDataName: {oprefix + thinDataName, legacyPoolPrefix + thinDataName},
+	}
+	// Every layer below a stacked device carries the prefix as well
+	for name, device := range d.Devices {
+		for _, layer := range d.getDeviceStack(name, device) {
+			candidates[layer.name] = []string{oprefix + layer.name, layer.name}
+		}
+	}
+
+	for name, dmnames := range candidates {
+		newname := d.getDmName(name)
+		if d.hasDmDevice(newname) {
+			continue
+		}
+
+		for _, dmname := range dmnames {
+			if dmname == newname || !d.hasDmDevice(dmname) {
+				continue
+			}
+
+			log.Printf("overlit: rename device (%v -> %v)\n", dmname, newname)
+
+			if err := d.renameDevice(dmname, newname); err != nil {
+				return errors.Wrapf(err, "could not rename %v device", dmname)
+			}
+
+			break
+		}
+	}
+
+	return nil
+}
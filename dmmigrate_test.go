@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func decodeConfig(t *testing.T, jsondata string) map[string]interface{} {
+	config := map[string]interface{}{}
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(jsondata)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	return config
+}
+
+func TestMigrateConfigV1(t *testing.T) {
+	config := decodeConfig(t, `{"devices": {"a": {"targets": [2563, 511]}, "b": {"targets": []}}}`)
+
+	if err := migrateConfigV1(config); err != nil {
+		t.Fatal(err)
+	}
+
+	devices := config["devices"].(map[string]interface{})
+
+	targets := devices["a"].(map[string]interface{})["targets"]
+	expected := []interface{}{
+		map[string]interface{}{"start": uint64(10), "count": uint64(3)},
+		map[string]interface{}{"start": uint64(1), "count": uint64(255)},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Fatalf("targets = %v, expected %v", targets, expected)
+	}
+
+	if targets := devices["b"].(map[string]interface{})["targets"].([]interface{}); len(targets) != 0 {
+		t.Fatalf("targets = %v, expected none", targets)
+	}
+}
+
+func TestMigrateConfigV1Invalid(t *testing.T) {
+	config := decodeConfig(t, `{"devices": {"a": {"targets": [{"start": 1}]}}}`)
+
+	if err := migrateConfigV1(config); err == nil {
+		t.Fatal("migrated targets that are not packed")
+	}
+}
+
+func TestMigrateConfigV2(t *testing.T) {
+	config := decodeConfig(t, `{"version": 2, "devpath": "/dev/sdb", "devices": {"a": {"targets": [{"start": 10, "count": 3}]}}}`)
+
+	if err := migrateConfigV2(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := config["devpath"]; ok {
+		t.Fatal("devpath is left in config")
+	}
+	if devpaths := config["devpaths"]; !reflect.DeepEqual(devpaths, []interface{}{"/dev/sdb"}) {
+		t.Fatalf("devpaths = %v, expected [/dev/sdb]", devpaths)
+	}
+
+	target := config["devices"].(map[string]interface{})["a"].(map[string]interface{})["targets"].([]interface{})[0].(map[string]interface{})
+	if target["device"] != 0 {
+		t.Fatalf("device = %v, expected 0", target["device"])
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmmigrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonpath := filepath.Join(dir, "dmtool.json")
+	jsondata := []byte(`{"devpath": "/dev/sdb", "extentsize": 4194304, "devices": {"a": {"targets": [2563, 4098], "extents": 5}}}`)
+
+	migrated, ok, err := migrateConfig(jsonpath, jsondata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("config is not migrated")
+	}
+
+	backup, err := ioutil.ReadFile(jsonpath + ".v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(backup, jsondata) {
+		t.Fatalf("backup = %s, expected %s", backup, jsondata)
+	}
+
+	d := &DmTool{}
+	if err := json.Unmarshal(migrated, d); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Version != dmToolVersion {
+		t.Fatalf("version = %v, expected %v", d.Version, dmToolVersion)
+	}
+	if !reflect.DeepEqual(d.DevPaths, []string{"/dev/sdb"}) {
+		t.Fatalf("devpaths = %v, expected [/dev/sdb]", d.DevPaths)
+	}
+
+	expected := []DmExtentRun{{0, 10, 3}, {0, 16, 2}}
+	if !reflect.DeepEqual(d.Devices["a"].Targets, expected) {
+		t.Fatalf("targets = %v, expected %v", d.Devices["a"].Targets, expected)
+	}
+
+	// Current configs are passed through untouched
+	current, ok, err := migrateConfig(jsonpath, migrated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || !bytes.Equal(current, migrated) {
+		t.Fatal("current config is migrated again")
+	}
+}
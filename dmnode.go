@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	udevAuto = "auto"
+	udevOn   = "on"
+	udevOff  = "off"
+
+	udevControlPath = "/run/udev/control"
+	devMapperDir    = "/dev/mapper"
+)
+
+func detectUdev(mode string) bool {
+	switch mode {
+	case udevOn:
+		return true
+	case udevOff:
+		return false
+	}
+
+	// A stale socket file outlives udevd, only a listener accepts the connection
+	conn, err := net.Dial("unixpacket", udevControlPath)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	return true
+}
+
+func isDmNode(nodepath string, rdev uint64) bool {
+	st := syscall.Stat_t{}
+	if err := syscall.Stat(nodepath, &st); err != nil {
+		return false
+	}
+
+	return st.Mode&syscall.S_IFMT == syscall.S_IFBLK && uint64(st.Rdev) == rdev
+}
+
+func (d *DmTool) setCookie(task *dmTask, cookie *uint, flags uint16) int {
+	// Without udev the library must not touch the nodes either, syncNode keeps them in step
+	if !d.udev {
+		flags |= dmUdevDisableLibraryFallback
+	}
+
+	return dmTaskSetCookie(task, cookie, flags)
+}
+
+func (d *DmTool) getDmInfo(dmname string) (*DmInfo, error) {
+	info := &DmInfo{}
+
+	task, err := d.createRawTask(deviceInfo, "info", dmname)
+	if err != nil {
+		return nil, err
+	}
+	defer dmTaskDestroy(task)
+
+	if err := d.runTask(task, "info", dmname); err != nil {
+		return nil, err
+	}
+	if dmTaskGetInfo(task, info) == 0 {
+		return nil, &DmError{Op: "info", Name: dmname}
+	}
+
+	return info, nil
+}
+
+func (d *DmTool) syncNode(dmname string) error {
+	if d.udev {
+		return nil
+	}
+
+	nodepath := path.Join(devMapperDir, dmname)
+
+	info, err := d.getDmInfo(dmname)
+	if err != nil {
+		return err
+	}
+
+	if info.Exists == 0 {
+		if err := os.Remove(nodepath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	rdev := unix.Mkdev(info.Major, info.Minor)
+
+	if isDmNode(nodepath, rdev) {
+		return nil
+	}
+
+	// A node left by an older device with the same name points somewhere else
+	if err := os.Remove(nodepath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(devMapperDir, 0755); err != nil {
+		return err
+	}
+
+	// Someone else may have made the node in the meantime, which is fine if it is the right one
+	if err := unix.Mknod(nodepath, unix.S_IFBLK|0600, int(rdev)); err != nil {
+		if err != unix.EEXIST || !isDmNode(nodepath, rdev) {
+			return errors.Wrapf(err, "could not make %v node", dmname)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+type DmPolicy interface {
+	// FindRun picks a free run and returns the part of it to allocate
+	FindRun(runs []DmExtentRun, count uint64, readonly bool) (DmExtentRun, bool)
+}
+
+type firstFitPolicy struct{}
+
+type bestFitPolicy struct{}
+
+type largestPolicy struct{}
+
+type roFrontPolicy struct{}
+
+var dmPolicies = map[string]DmPolicy{
+	"firstfit": firstFitPolicy{},
+	"bestfit":  bestFitPolicy{},
+	"largest":  largestPolicy{},
+	"rofront":  roFrontPolicy{},
+}
+
+func getDmPolicy(name string) (DmPolicy, error) {
+	if policy, ok := dmPolicies[name]; ok {
+		return policy, nil
+	}
+
+	return nil, errors.Errorf("not supported %v allocation policy", name)
+}
+
+func takeHead(run DmExtentRun, count uint64) DmExtentRun {
+	return DmExtentRun{run.Device, run.Start, getMinUint64(run.Count, count)}
+}
+
+func takeTail(run DmExtentRun, count uint64) DmExtentRun {
+	count = getMinUint64(run.Count, count)
+
+	return DmExtentRun{run.Device, run.Start + run.Count - count, count}
+}
+
+func (p firstFitPolicy) FindRun(runs []DmExtentRun, count uint64, readonly bool) (DmExtentRun, bool) {
+	if len(runs) == 0 {
+		return DmExtentRun{}, false
+	}
+
+	for _, run := range runs {
+		if run.Count >= count {
+			return takeHead(run, count), true
+		}
+	}
+
+	return takeHead(runs[0], count), true
+}
+
+func (p bestFitPolicy) FindRun(runs []DmExtentRun, count uint64, readonly bool) (DmExtentRun, bool) {
+	best := -1
+
+	for i, run := range runs {
+		if run.Count >= count && (best < 0 || run.Count < runs[best].Count) {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return largestPolicy{}.FindRun(runs, count, readonly)
+	}
+
+	return takeHead(runs[best], count), true
+}
+
+func (p largestPolicy) FindRun(runs []DmExtentRun, count uint64, readonly bool) (DmExtentRun, bool) {
+	largest := -1
+
+	for i, run := range runs {
+		if largest < 0 || run.Count > runs[largest].Count {
+			largest = i
+		}
+	}
+
+	if largest < 0 {
+		return DmExtentRun{}, false
+	}
+
+	return takeHead(runs[largest], count), true
+}
+
+func (p roFrontPolicy) FindRun(runs []DmExtentRun, count uint64, readonly bool) (DmExtentRun, bool) {
+	// Image layers fill the device from the front, container devices from the back
+	if readonly {
+		return firstFitPolicy{}.FindRun(runs, count, readonly)
+	}
+
+	if len(runs) == 0 {
+		return DmExtentRun{}, false
+	}
+
+	for i := len(runs) - 1; i >= 0; i-- {
+		if runs[i].Count >= count {
+			return takeTail(runs[i], count), true
+		}
+	}
+
+	return takeTail(runs[len(runs)-1], count), true
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	reclaimNone    = "none"
+	reclaimDiscard = "discard"
+	reclaimZero    = "zero"
+	reclaimSecure  = "secure"
+)
+
+const (
+	blkDiscard    = 0x1277
+	blkSecDiscard = 0x127d
+	blkZeroOut    = 0x127f
+
+	reclaimChunkSize = 64 * 1024 * 1024
+)
+
+var reclaimRequests = map[string]uintptr{
+	reclaimDiscard: blkDiscard,
+	reclaimZero:    blkZeroOut,
+	reclaimSecure:  blkSecDiscard,
+}
+
+type DmReclaimStatus struct {
+	Policy  string
+	Devices int
+	Extents uint64
+	Failed  int
+	Current string
+	Done    uint64
+	Total   uint64
+}
+
+func (d *DmTool) needsReclaim(device *DmDevice) bool {
+	// Thin pools zero the blocks they hand out again, so only linear extents carry old data
+	return d.reclaim != "" && d.reclaim != reclaimNone && device.ThinId == 0 && len(device.getAllTargets()) > 0
+}
+
+func (d *DmTool) StartReclaim() {
+	if d.reclaim == "" || d.reclaim == reclaimNone {
+		return
+	}
+
+	d.reclaimwake = make(chan struct{}, 1)
+	d.reclaimstop = make(chan struct{})
+	d.reclaimdone = make(chan struct{})
+	d.reclaimfailed = make(map[string]bool)
+
+	stop := d.reclaimstop
+
+	go func() {
+		defer close(d.reclaimdone)
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if name := d.getNextReclaim(); name != "" {
+				d.reclaimDevice(name)
+				continue
+			}
+
+			select {
+			case <-d.reclaimwake:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (d *DmTool) stopReclaim() {
+	if d.reclaimstop == nil {
+		return
+	}
+
+	// A device being wiped is finished first, so its extents are not left half reclaimed
+	close(d.reclaimstop)
+	<-d.reclaimdone
+
+	d.reclaimstop = nil
+}
+
+func (d *DmTool) wakeReclaim() {
+	if d.reclaimwake == nil {
+		return
+	}
+
+	select {
+	case d.reclaimwake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *DmTool) getNextReclaim() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	names := []string{}
+	for name, device := range d.Devices {
+		if device.Reclaiming && !d.reclaimfailed[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	return names[0]
+}
+
+func (d *DmTool) wipeTarget(target DmExtentRun, done func(uint64)) error {
+	f, err := os.OpenFile(d.DevPaths[target.Device], os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	chunk := getMaxUint64(reclaimChunkSize/d.ExtentSize, 1)
+
+	for offset := uint64(0); offset < target.Count; offset += chunk {
+		count := getMinUint64(chunk, target.Count-offset)
+
+		r := [2]uint64{(target.Start + offset) * d.ExtentSize, count * d.ExtentSize}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), reclaimRequests[d.reclaim], uintptr(unsafe.Pointer(&r[0]))); errno != 0 {
+			return errors.Wrapf(errno, "could not %v extents (device = %v, start = %v, count = %v)", d.reclaim, target.Device, target.Start+offset, count)
+		}
+
+		done(count)
+	}
+
+	return nil
+}
+
+func (d *DmTool) reclaimDevice(name string) {
+	d.locker.Lock(name)
+	defer d.locker.Unlock(name)
+
+	d.mu.Lock()
+	device, ok := d.Devices[name]
+	if !ok || !device.Reclaiming {
+		d.mu.Unlock()
+		return
+	}
+
+	targets := device.getAllTargets()
+
+	d.reclaimstatus = DmReclaimStatus{Current: name, Total: getTargetsCount(targets)}
+	d.mu.Unlock()
+
+	var err error
+
+	for _, target := range targets {
+		if err = d.wipeTarget(target, func(count uint64) {
+			d.mu.Lock()
+			d.reclaimstatus.Done += count
+			d.mu.Unlock()
+		}); err != nil {
+			break
+		}
+	}
+
+	d.mu.Lock()
+
+	d.reclaimstatus = DmReclaimStatus{}
+
+	// Extents that could not be wiped stay reserved until the next start tries again
+	if err != nil {
+		log.Printf("overlit: failed to reclaim %v device: %v\n", name, err)
+
+		d.reclaimfailed[name] = true
+
+		d.mu.Unlock()
+		return
+	}
+
+	for _, target := range targets {
+		d.clearExtents(target)
+	}
+
+	delete(d.Devices, name)
+
+	err = d.logJournal("delete", name, device, nil)
+	d.mu.Unlock()
+
+	if err == nil {
+		err = d.syncJournal()
+	}
+	if err != nil {
+		log.Printf("overlit: failed to journal reclaim of %v device: %v\n", name, err)
+	}
+}
+
+func (d *DmTool) GetReclaimStatus() DmReclaimStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	status := d.reclaimstatus
+	status.Policy = d.reclaim
+
+	for name, device := range d.Devices {
+		if !device.Reclaiming {
+			continue
+		}
+
+		if d.reclaimfailed[name] {
+			status.Failed++
+		} else {
+			status.Devices++
+			status.Extents += device.getUsedExtents()
+		}
+	}
+
+	return status
+}
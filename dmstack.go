@@ -0,0 +1,177 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	baseLayer      = "base"
+	hashLayer      = "hash"
+	verityLayer    = "verity"
+	metaLayer      = "imeta"
+	integrityLayer = "integrity"
+	cryptLayer     = "crypt"
+	cacheMetaLayer = "cmeta"
+	cacheDataLayer = "cdata"
+	cacheLayer     = "cache"
+)
+
+type dmLayer struct {
+	name  string
+	table []dmTarget
+
+	// Cache layers write their metadata even below a sealed device
+	writable bool
+}
+
+func (device *DmDevice) isStacked() bool {
+	return device.RootHash != "" || device.Cipher != "" || device.Integrity != "" || device.CacheMode != ""
+}
+
+func (device *DmDevice) getUsedExtents() uint64 {
+	return device.Extents + getTargetsCount(device.HashTargets) + getTargetsCount(device.MetaTargets)
+}
+
+func getTargetsCount(targets []DmExtentRun) uint64 {
+	count := uint64(0)
+
+	for _, target := range targets {
+		count += target.Count
+	}
+
+	return count
+}
+
+func (device *DmDevice) getAllTargets() []DmExtentRun {
+	targets := append([]DmExtentRun{}, device.Targets...)
+
+	targets = append(targets, device.HashTargets...)
+
+	return append(targets, device.MetaTargets...)
+}
+
+func (d *DmTool) getDeviceStack(name string, device *DmDevice) []dmLayer {
+	// Devices without extents have nothing to stack on yet
+	if !device.isStacked() || device.Extents == 0 {
+		return []dmLayer{{name: name, table: d.getDeviceTable(device)}}
+	}
+
+	// Extents are mapped by the base device and every upper layer maps the one below it
+	stack := []dmLayer{{name: name + "-" + baseLayer, table: d.getDeviceTable(device), writable: device.CacheMode != ""}}
+	lower := d.GetDevicePath(stack[0].name)
+
+	if device.CacheMode != "" {
+		stack = append(stack, d.getCacheLayers(name, device, lower)...)
+		lower = d.GetDevicePath(stack[len(stack)-1].name)
+	}
+
+	if device.Integrity != "" {
+		meta := name + "-" + metaLayer
+		upper := name + "-" + integrityLayer
+
+		stack = append(stack, dmLayer{name: meta, table: d.getLinearTargets(device.MetaTargets)})
+		stack = append(stack, dmLayer{name: upper, table: d.getIntegrityTable(device, lower, d.GetDevicePath(meta))})
+
+		lower = d.GetDevicePath(upper)
+	}
+
+	if device.Cipher != "" {
+		upper := name + "-" + cryptLayer
+
+		stack = append(stack, dmLayer{name: upper, table: d.getCryptTable(device, lower, d.keys[name])})
+
+		lower = d.GetDevicePath(upper)
+	}
+
+	if device.RootHash != "" {
+		hash := name + "-" + hashLayer
+
+		stack = append(stack, dmLayer{name: hash, table: d.getLinearTargets(device.HashTargets)})
+		stack = append(stack, dmLayer{name: name + "-" + verityLayer, table: d.getVerityTable(device, lower, d.GetDevicePath(hash))})
+	}
+
+	// Nothing maps the topmost layer, so it can take the name of the device itself
+	stack[len(stack)-1].name = name
+
+	return stack
+}
+
+func (d *DmTool) isStackDevice(name string) bool {
+	index := strings.LastIndex(name, "-")
+	if index < 0 {
+		return false
+	}
+
+	device, ok := d.Devices[name[:index]]
+	if !ok {
+		return false
+	}
+
+	for _, layer := range d.getDeviceStack(name[:index], device) {
+		if layer.name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *DmTool) activateStack(stack []dmLayer, readonly bool) error {
+	for _, layer := range stack {
+		if err := d.ensureDevice(layer.name); err != nil {
+			return err
+		}
+
+		if err := d.activateDevice(layer.name, layer.table, readonly && !layer.writable); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *DmTool) detachStack(stack []dmLayer) error {
+	// Upper layers hold the lower ones open, so they go first
+	for i := len(stack) - 1; i >= 0; i-- {
+		// Deferred removals leave the node of a device the kernel dropped on its own
+		if d.checkDevice(stack[i].name) == 0 {
+			d.syncNode(d.getDmName(stack[i].name))
+			continue
+		}
+
+		if err := d.detachDevice(stack[i].name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *DmTool) allocateTargets(count uint64) ([]DmExtentRun, error) {
+	allocated := []DmExtentRun{}
+
+	runs := d.getFreeRuns()
+
+	for count > 0 {
+		target, found := d.policy.FindRun(runs, count, true)
+		if !found || target.Count == 0 {
+			for _, target := range allocated {
+				d.clearExtents(target)
+			}
+
+			return nil, errors.New("could not allocate extents")
+		}
+
+		d.setExtents(target)
+
+		runs = takeFreeRun(runs, target)
+
+		allocated = append(allocated, target)
+
+		count -= target.Count
+	}
+
+	return allocated, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	thinPoolName = "pool"
+	thinMetaName = "pool-meta"
+	thinDataName = "pool-data"
+
+	legacyPoolPrefix = "overlit-"
+)
+
+func (d *DmTool) getPoolPath() string {
+	return d.GetDevicePath(thinPoolName)
+}
+
+func (d *DmTool) getThinMetaExtents() uint64 {
+	// Thin pool metadata needs about 48 bytes per data block (see thin-provisioning.txt)
+	metasize := 48 * d.getTotalExtents()
+	metasize = getMaxUint64(metasize, 2*1024*1024)
+	metasize = getMinUint64(metasize, 16*1024*1024*1024)
+
+	return (metasize + d.ExtentSize - 1) / d.ExtentSize
+}
+
+func (d *DmTool) messageDevice(devname, message string) error {
+	task, err := d.createTask(deviceTargetMsg, "message", devname)
+	if err != nil {
+		return err
+	}
+	defer dmTaskDestroy(task)
+
+	if dmTaskSetSector(task, 0) == 0 || dmTaskSetMessage(task, message) == 0 {
+		return &DmError{Op: "message", Name: devname}
+	}
+
+	return d.runTask(task, "message", devname)
+}
+
+func (d *DmTool) setupLinear(devname string, targets []DmExtentRun) error {
+	if err := d.ensureDevice(devname); err != nil {
+		return err
+	}
+
+	if err := d.loadDevice(devname, d.getLinearTargets(targets), false); err != nil {
+		return err
+	}
+
+	return d.resumeDevice(devname)
+}
+
+func (d *DmTool) formatThinMeta() error {
+	f, err := os.OpenFile(d.GetDevicePath(thinMetaName), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// A zeroed superblock makes the kernel format fresh pool metadata
+	if _, err := f.Write(make([]byte, 4096)); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func (d *DmTool) setupPool(format bool) error {
+	multis := uint64(d.ExtentSize / 512)
+
+	// Pool data blocks share the extent size, which has to be a multiple of 64KB
+	if multis%128 != 0 {
+		return errors.Errorf("%v extent size is not available for thin pool", d.ExtentSize)
+	}
+
+	if d.ThinMeta == 0 {
+		d.ThinMeta = d.getThinMetaExtents()
+	}
+	if d.ThinMeta >= d.backings[0].extents {
+		return errors.New("could not fit thin pool metadata")
+	}
+
+	// Metadata lives at the front of the first device and data spans everything else
+	meta := []DmExtentRun{{0, 0, d.ThinMeta}}
+	data := []DmExtentRun{{0, d.ThinMeta, d.backings[0].extents - d.ThinMeta}}
+	for device := 1; device < len(d.backings); device++ {
+		data = append(data, DmExtentRun{device, 0, d.backings[device].extents})
+	}
+
+	extents := uint64(0)
+	for _, target := range data {
+		extents += target.Count
+	}
+
+	log.Printf("overlit: setup thin pool (meta = %v extents, data = %v extents, format = %v)\n", d.ThinMeta, extents, format)
+
+	// Every extent belongs to the pool, so the linear allocator never hands them out
+	for _, target := range append(meta, data...) {
+		d.setExtents(target)
+	}
+
+	if err := d.setupLinear(thinMetaName, meta); err != nil {
+		return errors.Wrap(err, "could not setup thin pool metadata device")
+	}
+	if err := d.setupLinear(thinDataName, data); err != nil {
+		return errors.Wrap(err, "could not setup thin pool data device")
+	}
+
+	if format {
+		if err := d.formatThinMeta(); err != nil {
+			return errors.Wrap(err, "could not format thin pool metadata")
+		}
+	}
+
+	if err := d.ensureDevice(thinPoolName); err != nil {
+		return errors.Wrap(err, "could not create thin pool")
+	}
+
+	if err := d.loadDevice(thinPoolName, []dmTarget{
+		{0, extents * multis, "thin-pool", fmt.Sprintf("%v %v %v 0", d.GetDevicePath(thinMetaName), d.GetDevicePath(thinDataName), multis)},
+	}, false); err != nil {
+		return errors.Wrap(err, "could not reload thin pool")
+	}
+
+	return d.resumeDevice(thinPoolName)
+}
+
+func (d *DmTool) createThin(device *DmDevice) error {
+	// Layers reach their parents through overlay lowerdirs, so a snapshot of the parent would only repeat it in the upper
+	return d.messageDevice(thinPoolName, fmt.Sprintf("create_thin %v", device.ThinId))
+}
+
+func (d *DmTool) deleteThin(device *DmDevice) error {
+	return d.messageDevice(thinPoolName, fmt.Sprintf("delete %v", device.ThinId))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,362 +9,1548 @@ import (
 	"log"
 	"math"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
 
+	"github.com/docker/docker/pkg/locker"
 	"github.com/pkg/errors"
 	"github.com/willf/bitset"
 )
 
+type DmExtentRun struct {
+	Device int    `json:"device"`
+	Start  uint64 `json:"start"`
+	Count  uint64 `json:"count"`
+}
+
 type DmDevice struct {
-	Targets     []uint64 `json:"targets"`
-	Extents     uint64   `json:"extents"`
-	FsType      string   `json:"fstype"`
-	MntPath     string   `json:"mntpath"`
-	Readonly    bool     `json:"readonly"`
-	ExtentStart uint64   `json:"extentstart"`
-	ExtentCount uint64   `json:"extentcount"`
+	Targets     []DmExtentRun `json:"targets"`
+	Extents     uint64        `json:"extents"`
+	FsType      string        `json:"fstype"`
+	MntPath     string        `json:"mntpath"`
+	Readonly    bool          `json:"readonly"`
+	ExtentStart uint64        `json:"extentstart"`
+	ExtentCount uint64        `json:"extentcount"`
+	ThinId      uint64        `json:"thinid,omitempty"`
+	Group       string        `json:"group,omitempty"`
+	ImageSize   uint64        `json:"imagesize,omitempty"`
+	Sealed      bool          `json:"sealed,omitempty"`
+	Cipher      string        `json:"cipher,omitempty"`
+	Integrity   string        `json:"integrity,omitempty"`
+	Removing    bool          `json:"removing,omitempty"`
+	Reclaiming  bool          `json:"reclaiming,omitempty"`
+	CacheMode   string        `json:"cachemode,omitempty"`
+
+	HashTargets  []DmExtentRun `json:"hashtargets,omitempty"`
+	RootHash     string        `json:"roothash,omitempty"`
+	Salt         string        `json:"salt,omitempty"`
+	VerityBlocks uint64        `json:"verityblocks,omitempty"`
+
+	MetaTargets []DmExtentRun `json:"metatargets,omitempty"`
+
+	CacheTargets []DmExtentRun `json:"cachetargets,omitempty"`
+}
+
+type DmTool struct {
+	Version    int                  `json:"version"`
+	DevPaths   []string             `json:"devpaths"`
+	ExtentSize uint64               `json:"extentsize"`
+	Allocator  string               `json:"allocator"`
+	ThinMeta   uint64               `json:"thinmeta,omitempty"`
+	ThinNextId uint64               `json:"thinnextid,omitempty"`
+	Prefix     string               `json:"prefix,omitempty"`
+	CachePath  string               `json:"cachepath,omitempty"`
+	Groups     map[string]*DmGroup  `json:"groups"`
+	Devices    map[string]*DmDevice `json:"devices"`
+
+	backings []*dmBacking
+
+	// Extents taken for operations in flight before any device owns them
+	reserved map[DmExtentRun]bool
+
+	policy DmPolicy
+
+	// Device fields change with both the device lock and mu held, so either one is enough to read them
+	mu     sync.Mutex
+	locker *locker.Locker
+
+	// Records are buffered under mu and only written and synced under jmu
+	jmu        sync.Mutex
+	journal    *os.File
+	journalbuf *bytes.Buffer
+	journalseq uint64
+	pending    map[uint64]dmJournalRecord
+
+	// Keys only live in memory, the json config must never hold them
+	keyprovider DmKeyProvider
+	keys        map[string]string
+
+	reclaim       string
+	reclaimwake   chan struct{}
+	reclaimstop   chan struct{}
+	reclaimdone   chan struct{}
+	reclaimfailed map[string]bool
+	reclaimstatus DmReclaimStatus
+
+	cache     *dmBacking
+	cachemode string
+	cachesize uint64
+
+	// Read caches are evicted by the clock of their last attach once the cache device is full
+	cacheclock uint64
+	cacheused  map[string]uint64
+
+	udev bool
+
+	jsonpath string
+}
+
+type DmToolOptions struct {
+	DevPaths   []string
+	ExtentSize uint64
+	Allocator  string
+	Policy     string
+	GroupName  string
+	GroupQuota *uint64
+	Prefix     string
+
+	KeyProvider DmKeyProvider
+	Reclaim     string
+
+	CachePath string
+	CacheMode string
+	CacheSize uint64
+
+	Udev string
+}
+
+type DmCreateOptions struct {
+	Cipher    string
+	Integrity string
+}
+
+type DmSealOptions struct {
+	Verity bool
+	Salt   string
+
+	// Verify sees the root hash of the built tree before the verity table is loaded
+	Verify func(roothash string) error
+}
+
+type DmError struct {
+	Op    string
+	Name  string
+	Errno syscall.Errno
+}
+
+func (e *DmError) Error() string {
+	if e.Errno != 0 {
+		return fmt.Sprintf("dm %v %v: %v", e.Op, e.Name, e.Errno)
+	}
+
+	return fmt.Sprintf("dm %v %v failed", e.Op, e.Name)
+}
+
+type dmBacking struct {
+	extents    uint64
+	extentbits *bitset.BitSet
+
+	// Held for the life of the pool, so a second instance can not allocate the same extents
+	lock *os.File
+}
+
+type dmTarget struct {
+	start  uint64
+	size   uint64
+	ttype  string
+	params string
+}
+
+const (
+	linearAllocator = "linear"
+	thinAllocator   = "thin"
+)
+
+func (d *DmTool) isFreeExtent(device int, extent uint64) bool {
+	return !d.backings[device].extentbits.Test(uint(extent + 1))
+}
+
+func (d *DmTool) getTotalExtents() uint64 {
+	extents := uint64(0)
+
+	for _, backing := range d.backings {
+		extents += backing.extents
+	}
+
+	return extents
+}
+
+func getNextFreeExtent(extentbits *bitset.BitSet, extent uint64) uint64 {
+	if bit, ok := extentbits.NextClear(uint(extent + 1)); ok {
+		return uint64(bit) - 1
+	}
+
+	// Bits past the length of the bitset are never set
+	if length := uint64(extentbits.Len()); length > extent+1 {
+		return length - 1
+	}
+
+	return extent
+}
+
+func getNextUsedExtent(extentbits *bitset.BitSet, extent uint64) uint64 {
+	if bit, ok := extentbits.NextSet(uint(extent + 1)); ok {
+		return uint64(bit) - 1
+	}
+
+	return math.MaxUint64
+}
+
+func (d *DmTool) getFreeRuns() []DmExtentRun {
+	runs := []DmExtentRun{}
+
+	// Jump between set and clear bits instead of testing every extent
+	for device, backing := range d.backings {
+		for extent := getNextFreeExtent(backing.extentbits, 0); extent < backing.extents; {
+			end := getMinUint64(getNextUsedExtent(backing.extentbits, extent), backing.extents)
+
+			runs = append(runs, DmExtentRun{device, extent, end - extent})
+
+			extent = getNextFreeExtent(backing.extentbits, end)
+		}
+	}
+
+	return runs
+}
+
+func takeFreeRun(runs []DmExtentRun, target DmExtentRun) []DmExtentRun {
+	taken := make([]DmExtentRun, 0, len(runs)+1)
+
+	for _, run := range runs {
+		if run.Device != target.Device || target.Start >= run.Start+run.Count || target.Start+target.Count <= run.Start {
+			taken = append(taken, run)
+			continue
+		}
+
+		if target.Start > run.Start {
+			taken = append(taken, DmExtentRun{run.Device, run.Start, target.Start - run.Start})
+		}
+		if end := target.Start + target.Count; end < run.Start+run.Count {
+			taken = append(taken, DmExtentRun{run.Device, end, run.Start + run.Count - end})
+		}
+	}
+
+	return taken
+}
+
+func (d *DmTool) findExtents(device *DmDevice, runs []DmExtentRun, count uint64) (DmExtentRun, bool) {
+	// Grow the last target in place while the following extents are free
+	if len(device.Targets) > 0 {
+		last := device.Targets[len(device.Targets)-1]
+		next := last.Start + last.Count
+		ncount := uint64(0)
+
+		for ncount < count && next+ncount < d.backings[last.Device].extents && d.isFreeExtent(last.Device, next+ncount) {
+			ncount++
+		}
+
+		if ncount > 0 {
+			return DmExtentRun{last.Device, next, ncount}, true
+		}
+	}
+
+	return d.policy.FindRun(runs, count, device.Readonly)
+}
+
+func (d *DmTool) setExtents(target DmExtentRun) error {
+	extentbits := d.backings[target.Device].extentbits
+
+	for i := uint64(0); i < target.Count; i++ {
+		extentbits.Set(uint(target.Start + i + 1))
+	}
+
+	return nil
+}
+
+func (d *DmTool) reserveExtents(targets ...DmExtentRun) {
+	for _, target := range targets {
+		d.reserved[target] = true
+	}
+}
+
+func (d *DmTool) unreserveExtents(targets ...DmExtentRun) {
+	for _, target := range targets {
+		delete(d.reserved, target)
+	}
+}
+
+func (d *DmTool) clearExtents(target DmExtentRun) error {
+	extentbits := d.backings[target.Device].extentbits
+
+	for i := uint64(0); i < target.Count; i++ {
+		extentbits.Clear(uint(target.Start + i + 1))
+	}
+
+	return nil
+}
+
+func (d *DmTool) addBacking(devpath string) error {
+	devsize := getDeviceSize(devpath)
+	if devsize == 0 {
+		return errors.Errorf("%v extent device is not available", devpath)
+	}
+
+	lock, err := os.Open(devpath)
+	if err != nil {
+		return err
+	}
+
+	// Groups only split the accounting of one pool, instances never share a backing device
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+
+		if err == syscall.EWOULDBLOCK {
+			return errors.Errorf("%v extent device is used by another overlit instance", devpath)
+		}
+
+		return errors.Wrapf(err, "could not lock %v extent device", devpath)
+	}
+
+	extents := devsize / d.ExtentSize
+
+	log.Printf("overlit: add backing device (devpath = %v, devsize = %v bytes, extents = %v)\n", devpath, devsize, extents)
+
+	d.backings = append(d.backings, &dmBacking{
+		extents:    extents,
+		extentbits: bitset.New(uint(extents)),
+		lock:       lock,
+	})
+
+	return nil
+}
+
+func (d *DmTool) releaseBackings() {
+	for _, backing := range d.backings {
+		if backing.lock != nil {
+			backing.lock.Close()
+		}
+	}
+
+	d.backings = nil
+}
+
+func (d *DmTool) getDmName(name string) string {
+	return d.Prefix + name
+}
+
+func (d *DmTool) createTask(taskType int, op, devname string) (*dmTask, error) {
+	if devname != "" {
+		devname = d.getDmName(devname)
+	}
+
+	return d.createRawTask(taskType, op, devname)
+}
+
+func (d *DmTool) createRawTask(taskType int, op, dmname string) (*dmTask, error) {
+	task := dmTaskCreate(taskType)
+	if task == nil {
+		return nil, &DmError{Op: op, Name: dmname}
+	}
+
+	if dmname != "" && dmTaskSetName(task, dmname) == 0 {
+		dmTaskDestroy(task)
+		return nil, &DmError{Op: op, Name: dmname}
+	}
+
+	return task, nil
 }
 
-type DmTool struct {
-	DevPath    string               `json:"devpath"`
-	ExtentSize uint64               `json:"extentsize"`
-	Devices    map[string]*DmDevice `json:"devices"`
+func (d *DmTool) runTask(task *dmTask, op, devname string) error {
+	if res := dmTaskRun(task); res == 0 {
+		return &DmError{Op: op, Name: devname, Errno: syscall.Errno(dmTaskGetErrno(task))}
+	}
+
+	return nil
+}
+
+func (d *DmTool) attachDevice(devname string) error {
+	var cookie uint
+
+	task, err := d.createTask(deviceCreate, "create", devname)
+	if err != nil {
+		return err
+	}
+	defer dmTaskDestroy(task)
+
+	if dmTaskAddTarget(task, 0, 1, "zero", "") == 0 {
+		return &DmError{Op: "create", Name: devname}
+	}
+	if d.setCookie(task, &cookie, 0) == 0 {
+		return &DmError{Op: "create", Name: devname}
+	}
+	defer dmUdevWait(cookie)
+
+	if err := d.runTask(task, "create", devname); err != nil {
+		return err
+	}
+
+	return d.syncNode(d.getDmName(devname))
+}
+
+func (d *DmTool) detachDevice(devname string) error {
+	var cookie uint
+
+	task, err := d.createTask(deviceRemove, "remove", devname)
+	if err != nil {
+		return err
+	}
+	defer dmTaskDestroy(task)
+
+	if d.setCookie(task, &cookie, 0) == 0 {
+		return &DmError{Op: "remove", Name: devname}
+	}
+	defer dmUdevWait(cookie)
+
+	if err := d.runTask(task, "remove", devname); err != nil {
+		return err
+	}
+
+	return d.syncNode(d.getDmName(devname))
+}
+
+func (d *DmTool) deferDevice(devname string) error {
+	var cookie uint
+
+	task, err := d.createTask(deviceRemove, "remove", devname)
+	if err != nil {
+		return err
+	}
+	defer dmTaskDestroy(task)
+
+	if dmTaskDeferredRemove(task) == 0 {
+		return &DmError{Op: "remove", Name: devname}
+	}
+
+	// Without udev rules the library would drop the node even though the kernel keeps the device
+	if d.setCookie(task, &cookie, dmUdevDisableLibraryFallback) == 0 {
+		return &DmError{Op: "remove", Name: devname}
+	}
+	defer dmUdevWait(cookie)
+
+	if err := d.runTask(task, "remove", devname); err != nil {
+		return err
+	}
+
+	return d.syncNode(d.getDmName(devname))
+}
+
+func (d *DmTool) ensureDevice(devname string) error {
+	if res := d.checkDevice(devname); res == 0 {
+		return d.attachDevice(devname)
+	}
+
+	// Devices made before a restart may have no node in a fresh /dev
+	return d.syncNode(d.getDmName(devname))
+}
+
+func (d *DmTool) infoDevice(devname string) *DmInfo {
+	// A device the kernel does not know reads as one that does not exist
+	info, err := d.getDmInfo(d.getDmName(devname))
+	if err != nil {
+		return &DmInfo{}
+	}
+
+	return info
+}
+
+func (d *DmTool) checkDevice(devname string) int {
+	return d.infoDevice(devname).Exists
+}
+
+func (d *DmTool) loadDevice(devname string, targets []dmTarget, readonly bool) error {
+	task, err := d.createTask(deviceReload, "reload", devname)
+	if err != nil {
+		return err
+	}
+	defer dmTaskDestroy(task)
+
+	if readonly && dmTaskSetRo(task) == 0 {
+		return &DmError{Op: "reload", Name: devname}
+	}
+
+	for _, target := range targets {
+		if dmTaskAddTarget(task, target.start, target.size, target.ttype, target.params) == 0 {
+			return &DmError{Op: "reload", Name: devname}
+		}
+	}
+
+	return d.runTask(task, "reload", devname)
+}
+
+func (d *DmTool) clearDevice(devname string) error {
+	task, err := d.createTask(deviceClear, "clear", devname)
+	if err != nil {
+		return err
+	}
+	defer dmTaskDestroy(task)
+
+	return d.runTask(task, "clear", devname)
+}
+
+func (d *DmTool) getLinearTargets(targets []DmExtentRun) []dmTarget {
+	multis := uint64(d.ExtentSize / 512)
+
+	linears := []dmTarget{}
+	offset := uint64(0)
+
+	for _, target := range targets {
+		linears = append(linears, dmTarget{offset * multis, target.Count * multis, "linear", fmt.Sprintf("%v %v", d.DevPaths[target.Device], target.Start*multis)})
+
+		offset += target.Count
+	}
+
+	return linears
+}
+
+func (d *DmTool) getDeviceTable(device *DmDevice) []dmTarget {
+	multis := uint64(d.ExtentSize / 512)
+
+	// Devices without extents keep the placeholder table they were created with
+	if device.Extents == 0 {
+		return []dmTarget{{0, 1, "zero", ""}}
+	}
+
+	if device.ThinId != 0 {
+		return []dmTarget{
+			{0, device.Extents * multis, "thin", fmt.Sprintf("%v %v", d.getPoolPath(), device.ThinId)},
+		}
+	}
+
+	return d.getLinearTargets(device.Targets)
+}
+
+func (d *DmTool) resumeDevice(devname string) error {
+	var cookie uint
+
+	task, err := d.createTask(deviceResume, "resume", devname)
+	if err != nil {
+		return err
+	}
+	defer dmTaskDestroy(task)
+
+	if d.setCookie(task, &cookie, 0) == 0 {
+		return &DmError{Op: "resume", Name: devname}
+	}
+	defer dmUdevWait(cookie)
+
+	return d.runTask(task, "resume", devname)
+}
+
+func (d *DmTool) suspendDevice(devname string) error {
+	task, err := d.createTask(deviceSuspend, "suspend", devname)
+	if err != nil {
+		return err
+	}
+	defer dmTaskDestroy(task)
+
+	return d.runTask(task, "suspend", devname)
+}
+
+func (d *DmTool) activateDevice(devname string, table []dmTarget, readonly bool) error {
+	if err := d.loadDevice(devname, table, readonly); err != nil {
+		return err
+	}
+
+	// Drop the inactive table so a later resume can not pick it up
+	if err := d.resumeDevice(devname); err != nil {
+		d.clearDevice(devname)
+		return err
+	}
+
+	return nil
+}
+
+func (d *DmTool) Setup(opts DmToolOptions, jsonpath string) error {
+	devpaths := opts.DevPaths
+	extentsize := opts.ExtentSize
+	allocator := opts.Allocator
+
+	if len(devpaths) == 0 {
+		return errors.New("has no extent device")
+	}
+
+	if opts.Prefix == "" {
+		return errors.New("has no dm name prefix")
+	}
+
+	if allocator != linearAllocator && allocator != thinAllocator {
+		return errors.Errorf("not supported %v allocator", allocator)
+	}
+
+	policy, err := getDmPolicy(opts.Policy)
+	if err != nil {
+		return err
+	}
+	d.policy = policy
+
+	d.udev = detectUdev(opts.Udev)
+	if d.udev {
+		dmUdevSetSyncSupport(1)
+
+		// Without udev synchronization we could not wait for the nodes, so we make them ourselves
+		d.udev = dmUdevGetSyncSupport() != 0
+	} else {
+		dmUdevSetSyncSupport(0)
+	}
+
+	log.Printf("overlit: prepare (devpaths = %v, extentsize = %v bytes, allocator = %v, policy = %v, udev = %v)\n", devpaths, extentsize, allocator, opts.Policy, d.udev)
+
+	matched := false
+	migrated := false
+
+	if jsondata, err := ioutil.ReadFile(jsonpath); err == nil {
+		if jsondata, migrated, err = migrateConfig(jsonpath, jsondata); err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(jsondata, &d); err != nil {
+			return errors.New("could not parse json config")
+		}
+
+		// Configs written before the allocator option always used linear devices
+		if d.Allocator == "" {
+			d.Allocator = linearAllocator
+		}
+
+		matched = d.matchBackings(devpaths) && d.ExtentSize == extentsize && d.Allocator == allocator
+	}
+
+	if !matched {
+		// Recorded devices point at extents that a different pool would hand out again
+		if len(d.Devices) > 0 {
+			return errors.Errorf("could not reuse %v devices of another pool (devpaths = %v, extentsize = %v, allocator = %v)", len(d.Devices), d.DevPaths, d.ExtentSize, d.Allocator)
+		}
+
+		d.ThinMeta = 0
+		d.ThinNextId = 0
+	}
+
+	if matched {
+		// Keep devices added to the running pool and append newly configured ones
+		for _, devpath := range devpaths {
+			if !d.hasBacking(devpath) {
+				d.DevPaths = append(d.DevPaths, devpath)
+			}
+		}
+	} else {
+		d.DevPaths = devpaths
+	}
+
+	oprefix := d.Prefix
+
+	d.Version = dmToolVersion
+	d.ExtentSize = extentsize
+	d.Allocator = allocator
+	d.Prefix = opts.Prefix
+
+	if d.Groups == nil {
+		d.Groups = make(map[string]*DmGroup)
+	}
+
+	// The default group always exists and keeps its quota unless one is configured
+	group := d.getGroup(opts.GroupName)
+	if opts.GroupQuota != nil {
+		group.Quota = *opts.GroupQuota
+	}
+
+	// Devices created before groups existed belong to the default group
+	for _, device := range d.Devices {
+		if device.Group == "" {
+			device.Group = opts.GroupName
+		}
+	}
+
+	d.jsonpath = jsonpath
+
+	d.keyprovider = opts.KeyProvider
+	d.reclaim = opts.Reclaim
+
+	d.releaseBackings()
+
+	for _, devpath := range d.DevPaths {
+		if err := d.addBacking(devpath); err != nil {
+			return err
+		}
+	}
+
+	if err := d.setupCache(opts.CachePath, opts.CacheMode, opts.CacheSize); err != nil {
+		return err
+	}
+
+	if matched {
+		if err := d.renameDevices(oprefix); err != nil {
+			return err
+		}
+	}
+
+	if allocator == thinAllocator {
+		if err := d.setupPool(!matched); err != nil {
+			return err
+		}
+	}
+
+	replayed := 0
+
+	if matched {
+		if replayed, err = d.replayJournal(); err != nil {
+			return err
+		}
+
+		for devname, device := range d.Devices {
+			for _, target := range device.Targets {
+				device.ExtentStart = target.Start
+				device.ExtentCount = target.Count
+
+				d.setExtents(target)
+			}
+			for _, target := range device.HashTargets {
+				d.setExtents(target)
+			}
+			for _, target := range device.MetaTargets {
+				d.setExtents(target)
+			}
+			d.setCacheExtents(device.CacheTargets, true)
+
+			// The reaper finishes devices that were removed while busy and the reclaimer wipes deleted ones
+			if device.Removing || device.Reclaiming {
+				continue
+			}
+
+			// A device that lost its key stays inactive and keeps its extents until it is removed
+			if device.Cipher != "" {
+				key, err := d.loadKey(devname, device, false)
+				if err != nil {
+					log.Printf("overlit: failed to load key of %v device: %v\n", devname, err)
+					continue
+				}
+
+				d.keys[devname] = key
+			}
+
+			if err := d.activateStack(d.getDeviceStack(devname, device), device.Sealed); err != nil {
+				return errors.Wrap(err, "could not activate device")
+			}
+		}
+	}
+
+	if err := d.openJournal(); err != nil {
+		return err
+	}
+
+	// A journal of another pool does not apply here, so it is dropped with the flush
+	if migrated || replayed > 0 || !matched {
+		return d.Flush()
+	}
+
+	return nil
+}
+
+func (d *DmTool) matchBackings(devpaths []string) bool {
+	if len(d.DevPaths) == 0 {
+		return false
+	}
+
+	// Targets refer to backing devices by index, so every device has to keep its place
+	for i := 0; i < len(d.DevPaths) && i < len(devpaths); i++ {
+		if d.DevPaths[i] != devpaths[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (d *DmTool) hasBacking(devpath string) bool {
+	for _, _devpath := range d.DevPaths {
+		if _devpath == devpath {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *DmTool) AddBackingDevice(devpath string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.hasBacking(devpath) {
+		return errors.Errorf("%v extent device is already in the pool", devpath)
+	}
+
+	if err := d.addBacking(devpath); err != nil {
+		return err
+	}
+
+	d.DevPaths = append(d.DevPaths, devpath)
+
+	// Thin pools take the new extents into their data device
+	if d.Allocator == thinAllocator {
+		if err := d.setupPool(false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *DmTool) GrowBackingDevices() ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	grown := []string{}
+
+	for device, backing := range d.backings {
+		extents := getDeviceSize(d.DevPaths[device]) / d.ExtentSize
+		if extents <= backing.extents {
+			continue
+		}
+
+		log.Printf("overlit: grow backing device (devpath = %v, extents = %v -> %v)\n", d.DevPaths[device], backing.extents, extents)
+
+		// Extents past the old end are not set in the bitset, so they are free already
+		backing.extents = extents
+
+		grown = append(grown, d.DevPaths[device])
+	}
+
+	if len(grown) > 0 && d.Allocator == thinAllocator {
+		if err := d.setupPool(false); err != nil {
+			return grown, err
+		}
+	}
+
+	return grown, nil
+}
+
+func (d *DmTool) Cleanup() {
+	d.stopReclaim()
+
+	d.Flush()
+
+	d.closeJournal()
+
+	d.releaseBackings()
+}
+
+func (d *DmTool) Flush() error {
+	// Holding jmu keeps records of later operations out of the journal until it is truncated
+	d.jmu.Lock()
+	defer d.jmu.Unlock()
+
+	d.mu.Lock()
+	jsondata, err := json.Marshal(d)
+	data := d.takeJournal()
+	pending := d.getPendingRecords()
+	d.mu.Unlock()
+
+	if err != nil {
+		return errors.New("could not encode json config")
+	}
+
+	// Records covered by the snapshot still go to disk, in case the snapshot does not
+	if err := d.appendJournal(data); err != nil {
+		return err
+	}
+
+	tmpfile, err := ioutil.TempFile(filepath.Dir(d.jsonpath), ".tmp")
+	if err != nil {
+		return errors.New("could not create temp file for json config")
+	}
+
+	n, err := tmpfile.Write(jsondata)
+	if err != nil {
+		return errors.New("could not write json config to temp file")
+	}
+	if n < len(jsondata) {
+		return io.ErrShortWrite
+	}
+	if err := tmpfile.Sync(); err != nil {
+		return errors.New("could not sync temp file")
+	}
+	if err := tmpfile.Close(); err != nil {
+		return errors.New("could not close temp file")
+	}
+	if err := os.Rename(tmpfile.Name(), d.jsonpath); err != nil {
+		return errors.New("could not commit json config")
+	}
+
+	return d.truncateJournal(pending)
+}
+
+func (d *DmTool) CreateDevice(name, group string, opts DmCreateOptions) error {
+	d.locker.Lock(name)
+	defer d.locker.Unlock(name)
+
+	device := &DmDevice{Group: group, Cipher: opts.Cipher, Integrity: opts.Integrity}
+
+	if device.Cipher != "" {
+		if err := checkCryptCipher(device.Cipher); err != nil {
+			return err
+		}
+	}
+
+	if device.Integrity != "" {
+		if _, err := getIntegrityTagSize(device.Integrity); err != nil {
+			return err
+		}
+
+		// Metadata extents are taken from the backing devices, which a thin pool owns alone
+		if d.Allocator == thinAllocator {
+			return errors.New("not supported integrity on thin allocator")
+		}
+	}
+
+	d.mu.Lock()
+	if _, ok := d.Devices[name]; ok {
+		d.mu.Unlock()
+		return errors.Errorf("%v device already exists", name)
+	}
+
+	// Layers may only pick groups the admin created, so containers can not dodge a quota
+	if _, ok := d.Groups[group]; !ok {
+		d.mu.Unlock()
+		return errors.Errorf("has no %v group", group)
+	}
+
+	// Reserve the thin id before the pool gets it, so a crash in between can not leak it
+	if d.Allocator == thinAllocator {
+		d.ThinNextId++
+
+		device.ThinId = d.ThinNextId
+	}
+
+	seq, err := d.beginJournal("create", name, nil, device)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	abort := func() {
+		d.mu.Lock()
+		d.abortJournal(seq)
+		d.mu.Unlock()
+	}
+
+	if err := d.syncJournal(); err != nil {
+		abort()
+		return err
+	}
+
+	if device.ThinId != 0 {
+		if err := d.createThin(device); err != nil {
+			abort()
+			return err
+		}
+	}
+
+	undo := func() {
+		if device.Cipher != "" {
+			d.discardKey(name)
+		}
+
+		if device.ThinId != 0 {
+			d.deleteThin(device)
+		}
+
+		abort()
+	}
 
-	extentbits *bitset.BitSet
-	extents    uint64
+	key := ""
 
-	jsonpath string
-}
+	if device.Cipher != "" {
+		if key, err = d.loadKey(name, device, true); err != nil {
+			undo()
+			return err
+		}
+	}
 
-func init() {
-	dmUdevSetSyncSupport(1)
-}
+	if err := d.attachDevice(name); err != nil {
+		undo()
+		return err
+	}
+
+	d.mu.Lock()
+	d.Devices[name] = device
+
+	if key != "" {
+		d.keys[name] = key
+	}
+
+	err = d.commitJournal(seq)
+	d.mu.Unlock()
 
-func getTarget(target uint64) (start, count uint64) {
-	start = uint64(target >> 8)
-	count = uint64(target & 0xff)
+	if err != nil {
+		return err
+	}
 
-	return
+	return d.syncJournal()
 }
 
-func (d *DmTool) findExtents(start, count, extents, offset uint64) (uint64, uint64, uint64, uint64) {
-	ncount := uint64(0)
+func (d *DmTool) DeleteDevice(name string) error {
+	d.locker.Lock(name)
+	defer d.locker.Unlock(name)
+
+	d.mu.Lock()
+	device, ok := d.Devices[name]
+	if !ok {
+		d.mu.Unlock()
+		return errors.Errorf("has no %v device", name)
+	}
+	if device.Reclaiming {
+		d.mu.Unlock()
+		return nil
+	}
+
+	stack := d.getDeviceStack(name, device)
+
+	// Deleted extents are wiped before they go back to the pool, so the device stays until then
+	var reclaimed *DmDevice
+	if d.needsReclaim(device) {
+		reclaimed = device.clone()
+		reclaimed.Removing = false
+		reclaimed.Reclaiming = true
+		reclaimed.CacheMode = ""
+		reclaimed.CacheTargets = nil
+	}
+	d.mu.Unlock()
+
+	// A busy device keeps its extents reserved until the kernel lets it go
+	if d.getOpenCount(stack[len(stack)-1].name) > 0 {
+		return d.deferRemoval(name, device, stack)
+	}
+
+	d.mu.Lock()
+	seq, err := d.beginJournal("delete", name, device, reclaimed)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The record has to be on disk before the kernel drops the device
+	err = d.syncJournal()
+	if err == nil {
+		err = d.detachStack(stack)
+	}
+
+	if err != nil {
+		d.mu.Lock()
+		d.abortJournal(seq)
+		d.mu.Unlock()
 
-	for count < extents {
-		index, found := d.extentbits.NextClear(uint(offset + 1))
-		if !found {
-			break
+		if dmerr, ok := err.(*DmError); ok && dmerr.Errno == syscall.EBUSY {
+			return d.deferRemoval(name, device, stack)
 		}
-		if count == 0 {
-			start = uint64(index - 1)
-		} else if uint64(index) != offset+1 {
-			break
+
+		return err
+	}
+
+	d.mu.Lock()
+
+	if err := d.commitJournal(seq); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+
+	// Cache extents only ever held copies, the extents of the device are what gets wiped
+	d.setCacheExtents(device.CacheTargets, false)
+
+	if reclaimed != nil {
+		*device = *reclaimed
+
+		d.wakeReclaim()
+	} else {
+		for _, target := range device.getAllTargets() {
+			d.clearExtents(target)
 		}
 
-		d.extentbits.Set(index)
+		delete(d.Devices, name)
+	}
+
+	delete(d.keys, name)
+	delete(d.cacheused, name)
 
-		offset = uint64(index)
-		count++
-		ncount++
+	if device.ThinId != 0 {
+		err = d.deleteThin(device)
 	}
+	d.mu.Unlock()
 
-	return start, count, ncount, offset
-}
+	if jerr := d.syncJournal(); jerr != nil && err == nil {
+		err = jerr
+	}
 
-func (d *DmTool) setExtents(offset, count uint64) error {
-	for i := uint64(0); i < count; i++ {
-		d.extentbits.Set(uint(offset + i + 1))
+	// Without its key the data left on the extents can never be read again
+	if device.Cipher != "" {
+		if kerr := d.discardKey(name); kerr != nil && err == nil {
+			err = kerr
+		}
 	}
 
-	return nil
+	return err
 }
 
-func (d *DmTool) clearExtents(offset, count uint64) error {
-	for i := uint64(0); i < count; i++ {
-		d.extentbits.Clear(uint(offset + i + 1))
+func (d *DmTool) deferRemoval(name string, device *DmDevice, stack []dmLayer) error {
+	d.mu.Lock()
+	removing := device.Removing
+	d.mu.Unlock()
+
+	// The kernel keeps the deferred removal, so it is only asked for once
+	if removing {
+		return nil
 	}
 
-	return nil
-}
+	// The kernel drops every layer once its last user closes it and the reaper does the rest
+	for i := len(stack) - 1; i >= 0; i-- {
+		if d.checkDevice(stack[i].name) == 0 {
+			continue
+		}
 
-func (d *DmTool) attachDevice(devname string) error {
-	var cookie uint
+		if err := d.deferDevice(stack[i].name); err != nil {
+			return err
+		}
+	}
 
-	task := dmTaskCreate(deviceCreate)
-	dmTaskSetName(task, devname)
-	dmTaskAddTarget(task, 0, 1, "zero", "")
-	dmTaskSetCookie(task, &cookie, 0)
-	dmTaskRun(task)
-	dmTaskDestroy(task)
+	d.mu.Lock()
 
-	dmUdevWait(cookie)
+	log.Printf("overlit: defer removal of busy %v device\n", name)
 
-	return nil
-}
+	before := device.clone()
+	device.Removing = true
 
-func (d *DmTool) detachDevice(devname string) error {
-	var cookie uint
+	err := d.logJournal("update", name, before, device)
+	d.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
 
-	task := dmTaskCreate(deviceRemove)
-	dmTaskSetName(task, devname)
-	dmTaskSetCookie(task, &cookie, 0)
-	dmTaskRun(task)
-	dmTaskDestroy(task)
+	return d.syncJournal()
+}
 
-	dmUdevWait(cookie)
+func (d *DmTool) isDeferred(stack []dmLayer) bool {
+	for _, layer := range stack {
+		if info := d.infoDevice(layer.name); info.Exists != 0 && info.DeferredRemove != 0 {
+			return true
+		}
+	}
 
-	return nil
+	return false
 }
 
-func (d *DmTool) checkDevice(devname string) int {
-	info := &DmInfo{}
+func (d *DmTool) ReapDevices() []string {
+	d.mu.Lock()
+	names := []string{}
+	stacks := [][]dmLayer{}
+	for name, device := range d.Devices {
+		if device.Removing {
+			names = append(names, name)
+			stacks = append(stacks, d.getDeviceStack(name, device))
+		}
+	}
+	d.mu.Unlock()
+
+	reaped := []string{}
+
+	for i, name := range names {
+		// Layers the kernel still holds for their users are left to it
+		if d.isDeferred(stacks[i]) {
+			continue
+		}
 
-	task := dmTaskCreate(deviceInfo)
-	dmTaskSetName(task, devname)
-	dmTaskRun(task)
-	dmTaskGetInfo(task, info)
-	dmTaskDestroy(task)
+		if err := d.DeleteDevice(name); err != nil {
+			log.Printf("overlit: failed to reap %v device: %v\n", name, err)
+			continue
+		}
+
+		if d.HasDevice(name) != nil {
+			reaped = append(reaped, name)
+		}
+	}
 
-	return info.Exists
+	return reaped
 }
 
-func (d *DmTool) reloadDevice(devname string) error {
-	device := d.Devices[devname]
+func (d *DmTool) growTargets(device *DmDevice, count uint64) ([]DmExtentRun, error) {
+	allocated := []DmExtentRun{}
 
-	multis := uint64(d.ExtentSize / 512)
+	// Free runs are collected once for the whole batch and trimmed as targets are taken
+	runs := d.getFreeRuns()
+
+	for count > 0 {
+		target, found := d.findExtents(device, runs, count)
+		if !found || target.Count == 0 {
+			return allocated, errors.New("could not resize device")
+		}
 
-	task := dmTaskCreate(deviceReload)
-	dmTaskSetName(task, devname)
+		d.setExtents(target)
 
-	offset := uint64(0)
+		runs = takeFreeRun(runs, target)
 
-	for _, target := range device.Targets {
-		start, count := getTarget(target)
+		if last := len(device.Targets) - 1; last >= 0 && device.Targets[last].Device == target.Device && device.Targets[last].Start+device.Targets[last].Count == target.Start {
+			device.Targets[last].Count += target.Count
+		} else {
+			device.Targets = append(device.Targets, target)
+		}
 
-		dmTaskAddTarget(task, offset*multis, count*multis, "linear", fmt.Sprintf("%v %v", d.DevPath, start*multis))
+		allocated = append(allocated, target)
 
-		offset += count
+		count -= target.Count
 	}
 
-	dmTaskRun(task)
-	dmTaskDestroy(task)
-
-	return nil
+	return allocated, nil
 }
 
-func (d *DmTool) resumeDevice(devname string) error {
-	var cookie uint
+func (d *DmTool) shrinkTargets(device *DmDevice, count uint64) []DmExtentRun {
+	freed := []DmExtentRun{}
+
+	for count > 0 && len(device.Targets) > 0 {
+		last := len(device.Targets) - 1
+		target := device.Targets[last]
+		trim := getMinUint64(count, target.Count)
 
-	task := dmTaskCreate(deviceResume)
-	dmTaskSetName(task, devname)
-	dmTaskSetCookie(task, &cookie, 0)
-	dmTaskRun(task)
-	dmTaskDestroy(task)
+		if trim == target.Count {
+			device.Targets = device.Targets[:last]
+		} else {
+			device.Targets[last].Count -= trim
+		}
 
-	dmUdevWait(cookie)
+		freed = append(freed, DmExtentRun{target.Device, target.Start + target.Count - trim, trim})
 
-	return nil
+		count -= trim
+	}
+
+	return freed
 }
 
-func (d *DmTool) Setup(devpath string, extentsize uint64, jsonpath string) error {
-	devsize := getDeviceSize(devpath)
-	if devsize == 0 {
-		return errors.New("%v extent device is not available")
+func (d *DmTool) ResizeDevice(name string, size uint64) error {
+	d.locker.Lock(name)
+	defer d.locker.Unlock(name)
+
+	d.mu.Lock()
+
+	device, ok := d.Devices[name]
+	if !ok {
+		d.mu.Unlock()
+		return errors.Errorf("has no %v device", name)
 	}
 
-	log.Printf("overlit: prepare (devpath = %v, devsize = %v bytes, extentsize = %v bytes)\n", devpath, devsize, extentsize)
+	extents := getMaxUint64((size+d.ExtentSize-1)/d.ExtentSize, 1)
+	if extents == device.Extents {
+		d.mu.Unlock()
+		return nil
+	}
 
-	d.extents = uint64(math.Ceil(float64(devsize / extentsize)))
-	d.extentbits = bitset.New(uint(d.extents))
+	// Integrity tags grow with the data, so the quota has to cover them as well
+	metaextents := uint64(0)
+	if device.Integrity != "" {
+		metaextents = getMaxUint64(d.getIntegrityMetaExtents(device, extents), getTargetsCount(device.MetaTargets)) - getTargetsCount(device.MetaTargets)
+	}
 
-	if jsondata, err := ioutil.ReadFile(jsonpath); err == nil {
-		if err := json.Unmarshal(jsondata, &d); err != nil {
-			return errors.New("could not parse json config")
-		}
+	if err := d.checkGroupQuota(device, extents+metaextents); err != nil {
+		d.mu.Unlock()
+		return err
+	}
 
-		if d.DevPath == devpath && d.ExtentSize == extentsize {
-			for devname, device := range d.Devices {
-				for _, target := range device.Targets {
-					start, count := getTarget(target)
+	before := device.clone()
 
-					device.ExtentStart = start
-					device.ExtentCount = count
+	allocated := []DmExtentRun{}
+	freed := []DmExtentRun{}
 
-					d.setExtents(start, count)
-				}
+	rollback := func(allocated []DmExtentRun) {
+		for _, target := range allocated {
+			d.clearExtents(target)
+		}
+		d.unreserveExtents(freed...)
 
-				if res := d.checkDevice(devname); res == 0 {
-					d.attachDevice(devname)
-				}
+		*device = *before
+	}
 
-				if err := d.reloadDevice(devname); err != nil {
-					return errors.New("could not reload device")
-				}
-				if err := d.resumeDevice(devname); err != nil {
-					return errors.New("could not resume device")
-				}
+	// Thin devices only change the size of their table
+	if device.ThinId == 0 {
+		if extents > device.Extents {
+			var err error
+
+			if allocated, err = d.growTargets(device, extents-device.Extents); err != nil {
+				rollback(allocated)
+				d.mu.Unlock()
+				return err
 			}
+		} else {
+			freed = d.shrinkTargets(device, device.Extents-extents)
+
+			// The old table maps the tail until the new one is live, so fsck must not free it
+			d.reserveExtents(freed...)
 		}
-	}
 
-	d.DevPath = devpath
-	d.ExtentSize = extentsize
+		device.ExtentStart = 0
+		device.ExtentCount = 0
 
-	d.jsonpath = jsonpath
+		if len(device.Targets) > 0 {
+			device.ExtentStart = device.Targets[len(device.Targets)-1].Start
+			device.ExtentCount = device.Targets[len(device.Targets)-1].Count
+		}
+	}
 
-	return nil
-}
+	device.Extents = extents
 
-func (d *DmTool) Cleanup() {
-	d.Flush()
-}
+	fresh := device.Integrity != "" && len(device.MetaTargets) == 0
 
-func (d *DmTool) Flush() error {
-	jsondata, err := json.Marshal(d)
-	if err != nil {
-		return errors.New("could not encode json config")
+	if metaextents > 0 {
+		metas, err := d.allocateTargets(metaextents)
+		if err != nil {
+			rollback(allocated)
+			d.mu.Unlock()
+			return err
+		}
+
+		device.MetaTargets = append(append([]DmExtentRun{}, device.MetaTargets...), metas...)
+		allocated = append(allocated, metas...)
 	}
 
-	tmpfile, err := ioutil.TempFile(filepath.Dir(d.jsonpath), ".tmp")
+	seq, err := d.beginJournal("resize", name, before, device)
 	if err != nil {
-		return errors.New("could not create temp file for json config")
+		rollback(allocated)
+		d.mu.Unlock()
+		return err
 	}
 
-	n, err := tmpfile.Write(jsondata)
-	if err != nil {
-		return errors.New("could not write json config to temp file")
+	stack := d.getDeviceStack(name, device)
+
+	d.mu.Unlock()
+
+	// The record has to be on disk before the kernel sees the new table
+	err = d.syncJournal()
+
+	if err == nil && fresh {
+		err = d.wipeSuperblock(device.MetaTargets)
 	}
-	if n < len(jsondata) {
-		return io.ErrShortWrite
+
+	// Other devices can allocate while this table is loaded, grown extents are set and freed ones reserved
+	if err == nil {
+		err = d.activateStack(stack, device.Sealed)
 	}
-	if err := tmpfile.Sync(); err != nil {
-		return errors.New("could not sync temp file")
+
+	d.mu.Lock()
+
+	if err != nil {
+		rollback(allocated)
+		d.abortJournal(seq)
+		d.mu.Unlock()
+		return err
 	}
-	if err := tmpfile.Close(); err != nil {
-		return errors.New("could not close temp file")
+
+	if err := d.commitJournal(seq); err != nil {
+		d.mu.Unlock()
+		return err
 	}
-	if err := os.Rename(tmpfile.Name(), d.jsonpath); err != nil {
-		return errors.New("could not commit json config")
+
+	// Give the tail extents back only after the shrunk table is live
+	d.unreserveExtents(freed...)
+	for _, target := range freed {
+		d.clearExtents(target)
 	}
+	d.mu.Unlock()
 
-	return nil
+	return d.syncJournal()
 }
 
-func (d *DmTool) CreateDevice(name string) error {
-	device := &DmDevice{}
+func (d *DmTool) GetDevices() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	d.Devices[name] = device
+	names := []string{}
+	for name := range d.Devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	return d.attachDevice(name)
+	return names
 }
 
-func (d *DmTool) DeleteDevice(name string) error {
-	if device, ok := d.Devices[name]; ok {
-		for _, target := range device.Targets {
-			start, count := getTarget(target)
+func (d *DmTool) GetDevicePath(name string) string {
+	return path.Join(devMapperDir, d.getDmName(name))
+}
 
-			d.clearExtents(start, count)
-		}
+func (d *DmTool) HasDevice(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-		return d.detachDevice(name)
+	if _, ok := d.Devices[name]; ok {
+		return nil
 	}
 
 	return errors.Errorf("has no %v device", name)
 }
 
-func (d *DmTool) ResizeDevice(name string, size uint64) error {
-	if device, ok := d.Devices[name]; ok {
-		extents := getMaxUint64(uint64(math.Ceil(float64(size/d.ExtentSize))), 1)
-		if extents == device.Extents {
-			return nil
+func (d *DmTool) SealDevice(name string, opts DmSealOptions) error {
+	d.locker.Lock(name)
+	defer d.locker.Unlock(name)
+
+	d.mu.Lock()
+	device, ok := d.Devices[name]
+	if !ok {
+		d.mu.Unlock()
+		return errors.Errorf("has no %v device", name)
+	}
+	if device.Sealed {
+		d.mu.Unlock()
+		return nil
+	}
+
+	sealed := device.clone()
+	sealed.Sealed = true
+	d.mu.Unlock()
+
+	// Dirty pages could not be written back once the table is read-only
+	if f, err := os.OpenFile(d.GetDevicePath(name), os.O_RDONLY, 0); err == nil {
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return err
 		}
-		if extents > device.Extents {
-			remains := device.ExtentCount + (extents - device.Extents)
-			estart := device.ExtentStart
-			ecount := device.ExtentCount
-			eoffset := estart + ecount
-
-			for remains > 0 {
-				start, count, ncount, offset := d.findExtents(estart, ecount, getMinUint64(remains, 255), eoffset)
-				if ncount == 0 {
-					if eoffset == 0 {
-						return errors.New("could not resize device")
-					}
-
-					eoffset = 0
-					continue
-				}
+	}
 
-				if ecount > 0 {
-					device.Targets[len(device.Targets)-1] = start<<8 | count
-				} else {
-					device.Targets = append(device.Targets, start<<8|count)
-				}
+	if opts.Verity {
+		if d.Allocator == thinAllocator {
+			return errors.New("not supported verity on thin allocator")
+		}
 
-				device.ExtentStart = start
-				device.ExtentCount = count
+		if err := d.setupVerity(name, sealed, opts.Salt); err != nil {
+			return errors.Wrap(err, "could not setup verity")
+		}
+	}
 
-				remains -= count
-				eoffset = offset
-				estart = 0
-				ecount = 0
-			}
+	var err error
+	if opts.Verity && opts.Verify != nil {
+		err = opts.Verify(sealed.RootHash)
+	}
 
-			if err := d.reloadDevice(name); err != nil {
-				return err
-			}
-			if err := d.resumeDevice(name); err != nil {
-				return err
-			}
+	d.mu.Lock()
+	stack := d.getDeviceStack(name, sealed)
+
+	var seq uint64
+	if err == nil {
+		seq, err = d.beginJournal("seal", name, device, sealed)
+	}
+	d.mu.Unlock()
+
+	if err == nil {
+		err = d.syncJournal()
+	}
+
+	// The kernel rejects every write once the table is loaded read-only
+	if err == nil {
+		err = d.activateStack(stack, true)
+	}
+
+	if err != nil {
+		// Only the layers below the device itself were created here
+		d.detachStack(stack[:len(stack)-1])
 
-			device.Extents = extents
+		d.mu.Lock()
+		d.abortJournal(seq)
 
-			return nil
+		for _, target := range sealed.HashTargets {
+			d.clearExtents(target)
 		}
+		d.unreserveExtents(sealed.HashTargets...)
+		d.mu.Unlock()
+
+		return err
 	}
 
-	return errors.Errorf("has no %v device", name)
-}
+	d.mu.Lock()
+	*device = *sealed
 
-func (d *DmTool) HasDevice(name string) error {
-	if _, ok := d.Devices[name]; ok {
-		return nil
+	d.unreserveExtents(sealed.HashTargets...)
+
+	err = d.commitJournal(seq)
+	d.mu.Unlock()
+
+	if err != nil {
+		return err
 	}
 
-	return errors.Errorf("has no %v device", name)
+	return d.syncJournal()
 }
 
-func (d *DmTool) SetDeviceFsType(name, fstype string) error {
-	if device, ok := d.Devices[name]; ok {
-		device.FsType = fstype
+func (d *DmTool) GetDeviceRootHash(name string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-		return nil
+	if device, ok := d.Devices[name]; ok {
+		return device.RootHash, nil
 	}
 
-	return errors.Errorf("has no %v device", name)
+	return "", errors.Errorf("has no %v device", name)
 }
 
-func (d *DmTool) SetDeviceMntPath(name, mntpath string) error {
-	if device, ok := d.Devices[name]; ok {
-		device.MntPath = mntpath
+func (d *DmTool) updateDevice(name string, update func(device *DmDevice)) error {
+	d.locker.Lock(name)
+	defer d.locker.Unlock(name)
 
-		return nil
+	d.mu.Lock()
+	device, ok := d.Devices[name]
+	if !ok {
+		d.mu.Unlock()
+		return errors.Errorf("has no %v device", name)
 	}
 
-	return errors.Errorf("has no %v device", name)
+	before := device.clone()
+
+	update(device)
+
+	err := d.logJournal("update", name, before, device)
+	d.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return d.syncJournal()
+}
+
+func (d *DmTool) SetDeviceFsType(name, fstype string) error {
+	return d.updateDevice(name, func(device *DmDevice) {
+		device.FsType = fstype
+	})
+}
+
+func (d *DmTool) SetDeviceMntPath(name, mntpath string) error {
+	return d.updateDevice(name, func(device *DmDevice) {
+		device.MntPath = mntpath
+	})
 }
 
 func (d *DmTool) SetDeviceReadonly(name string, readonly bool) error {
-	if device, ok := d.Devices[name]; ok {
+	return d.updateDevice(name, func(device *DmDevice) {
 		device.Readonly = readonly
+	})
+}
 
-		return nil
-	}
-
-	return errors.Errorf("has no %v device", name)
+func (d *DmTool) SetDeviceImageSize(name string, imagesize uint64) error {
+	return d.updateDevice(name, func(device *DmDevice) {
+		device.ImageSize = imagesize
+	})
 }
 
 func (d *DmTool) GetDeviceFsType(name string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	if device, ok := d.Devices[name]; ok {
 		return device.FsType, nil
 	}
@@ -372,6 +1559,9 @@ func (d *DmTool) GetDeviceFsType(name string) (string, error) {
 }
 
 func (d *DmTool) GetDeviceMntPath(name string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	if device, ok := d.Devices[name]; ok {
 		return device.MntPath, nil
 	}
@@ -380,6 +1570,9 @@ func (d *DmTool) GetDeviceMntPath(name string) (string, error) {
 }
 
 func (d *DmTool) GetDeviceReadonly(name string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	if device, ok := d.Devices[name]; ok {
 		return device.Readonly, nil
 	}
@@ -387,7 +1580,39 @@ func (d *DmTool) GetDeviceReadonly(name string) (bool, error) {
 	return true, errors.Errorf("has no %v device", name)
 }
 
+func (d *DmTool) GetDeviceRemoving(name string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Deleted devices whose extents are still being wiped count as removing too
+	if device, ok := d.Devices[name]; ok {
+		return device.Removing || device.Reclaiming, nil
+	}
+
+	return false, errors.Errorf("has no %v device", name)
+}
+
+func (d *DmTool) GetDeviceActive(name string) (bool, error) {
+	if err := d.HasDevice(name); err != nil {
+		return false, err
+	}
+
+	// Setup leaves devices it could not restore, like crypt devices without their key, out of the kernel
+	return d.checkDevice(name) != 0, nil
+}
+
+func (d *DmTool) GetDeviceImageSize(name string) (uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if device, ok := d.Devices[name]; ok {
+		return device.ImageSize, nil
+	}
+
+	return 0, errors.Errorf("has no %v device", name)
+}
+
 func NewDmTool() *DmTool {
-	d := &DmTool{Devices: make(map[string]*DmDevice)}
+	d := &DmTool{Version: dmToolVersion, Groups: make(map[string]*DmGroup), Devices: make(map[string]*DmDevice), locker: locker.New(), keys: make(map[string]string), reserved: make(map[DmExtentRun]bool), cacheused: make(map[string]uint64)}
 	return d
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	verityBlockSize = 4096
+	verityAlgorithm = "sha256"
+	veritySaltSize  = 32
+
+	// Tables and veritysetup --salt both take a dash for no salt
+	verityNoSalt = "-"
+)
+
+func getVerityLevels(datablocks uint64) []uint64 {
+	// Level 0 hashes the data blocks and every level above hashes the one below
+	hashes := uint64(verityBlockSize / sha256.Size)
+	levels := []uint64{}
+
+	for blocks := datablocks; blocks > 1; {
+		blocks = (blocks + hashes - 1) / hashes
+		levels = append(levels, blocks)
+	}
+
+	return levels
+}
+
+func getVerityDigest(salt, block []byte) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(block)
+
+	return h.Sum(nil)
+}
+
+func buildVerityTree(r io.Reader, datablocks uint64, salt []byte) ([]byte, []byte, error) {
+	levels := getVerityLevels(datablocks)
+
+	block := make([]byte, verityBlockSize)
+	br := bufio.NewReaderSize(r, 1024*1024)
+
+	if len(levels) == 0 {
+		if _, err := io.ReadFull(br, block); err != nil {
+			return nil, nil, err
+		}
+
+		return nil, getVerityDigest(salt, block), nil
+	}
+
+	hashes := make([][]byte, len(levels))
+
+	for level, blocks := range levels {
+		hashes[level] = make([]byte, 0, blocks*verityBlockSize)
+
+		count := datablocks
+		if level > 0 {
+			count = levels[level-1]
+		}
+
+		for i := uint64(0); i < count; i++ {
+			if level == 0 {
+				if _, err := io.ReadFull(br, block); err != nil {
+					return nil, nil, err
+				}
+			} else {
+				block = hashes[level-1][i*verityBlockSize : (i+1)*verityBlockSize]
+			}
+
+			hashes[level] = append(hashes[level], getVerityDigest(salt, block)...)
+		}
+
+		// Every hash block is padded with zeros
+		hashes[level] = hashes[level][:blocks*verityBlockSize]
+	}
+
+	// The top level is stored first so the root block sits at the start of the hash device
+	tree := []byte{}
+	for level := len(levels) - 1; level >= 0; level-- {
+		tree = append(tree, hashes[level]...)
+	}
+
+	return tree, getVerityDigest(salt, hashes[len(levels)-1]), nil
+}
+
+func (d *DmTool) getVerityTable(device *DmDevice, datapath, hashpath string) []dmTarget {
+	return []dmTarget{
+		{0, device.VerityBlocks * verityBlockSize / 512, "verity", fmt.Sprintf("1 %v %v %v %v %v 0 %v %v %v", datapath, hashpath, verityBlockSize, verityBlockSize, device.VerityBlocks, verityAlgorithm, device.RootHash, device.Salt)},
+	}
+}
+
+func (d *DmTool) setupVerity(name string, device *DmDevice, hexsalt string) (rerr error) {
+	datablocks := device.Extents * d.ExtentSize / verityBlockSize
+
+	// Images of a known size are hashed alone, so publishers can sign the same root hash
+	if device.ImageSize > 0 {
+		datablocks = (device.ImageSize + verityBlockSize - 1) / verityBlockSize
+	}
+
+	hashblocks := uint64(0)
+	for _, blocks := range getVerityLevels(datablocks) {
+		hashblocks += blocks
+	}
+
+	salt := make([]byte, veritySaltSize)
+	if hexsalt == verityNoSalt {
+		salt = []byte{}
+	} else if hexsalt != "" {
+		var err error
+
+		if salt, err = hex.DecodeString(hexsalt); err != nil {
+			return errors.Wrap(err, "could not decode salt")
+		}
+	} else if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	hashname := name + "-" + hashLayer
+
+	hashextents := getMaxUint64((hashblocks*verityBlockSize+d.ExtentSize-1)/d.ExtentSize, 1)
+
+	d.mu.Lock()
+
+	// Hash extents count against the group like the data they cover
+	if err := d.checkGroupQuota(device, device.Extents+hashextents); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+
+	targets, err := d.allocateTargets(hashextents)
+	if err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	table := d.getLinearTargets(targets)
+
+	// Nobody owns the hash extents until the seal commits
+	d.reserveExtents(targets...)
+	d.mu.Unlock()
+
+	defer func() {
+		if rerr != nil {
+			if d.checkDevice(hashname) != 0 {
+				d.detachDevice(hashname)
+			}
+
+			d.mu.Lock()
+			for _, target := range targets {
+				d.clearExtents(target)
+			}
+			d.unreserveExtents(targets...)
+			d.mu.Unlock()
+		}
+	}()
+
+	if err := d.ensureDevice(hashname); err != nil {
+		return err
+	}
+	if err := d.activateDevice(hashname, table, false); err != nil {
+		return err
+	}
+
+	r, err := os.Open(d.GetDevicePath(name))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tree, root, err := buildVerityTree(r, datablocks, salt)
+	if err != nil {
+		return errors.Wrap(err, "could not build hash tree")
+	}
+
+	w, err := os.OpenFile(d.GetDevicePath(hashname), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if _, err := w.WriteAt(tree, 0); err != nil {
+		return err
+	}
+	if err := w.Sync(); err != nil {
+		return err
+	}
+
+	device.HashTargets = targets
+	device.RootHash = hex.EncodeToString(root)
+	device.Salt = hex.EncodeToString(salt)
+	if len(salt) == 0 {
+		device.Salt = verityNoSalt
+	}
+	device.VerityBlocks = datablocks
+
+	return nil
+}
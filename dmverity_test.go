@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func getVerityTestData(blocks uint64) []byte {
+	data := make([]byte, blocks*verityBlockSize)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	return data
+}
+
+func TestGetVerityLevels(t *testing.T) {
+	tests := []struct {
+		datablocks uint64
+		levels     []uint64
+	}{
+		{1, []uint64{}},
+		{2, []uint64{1}},
+		{128, []uint64{1}},
+		{129, []uint64{2, 1}},
+		{16384, []uint64{128, 1}},
+		{16385, []uint64{129, 2, 1}},
+	}
+
+	for _, test := range tests {
+		if levels := getVerityLevels(test.datablocks); !reflect.DeepEqual(levels, test.levels) {
+			t.Errorf("levels of %v blocks = %v, expected %v", test.datablocks, levels, test.levels)
+		}
+	}
+}
+
+func TestBuildVerityTree(t *testing.T) {
+	// Format 1 trees with sha256, 4096 byte blocks and a zero salt, cross-checked with an independent dm-verity tree builder
+	tests := []struct {
+		datablocks uint64
+		treesize   int
+		roothash   string
+	}{
+		{2, 4096, "1556a4eae5a733f51227dc4e90c5fa9b749a565b9f9fc381fa182248086a8717"},
+		{129, 12288, "a971469b9f357b484bf722edfac8b108ef508806a56865b468eb824742d9f058"},
+		{300, 16384, "e5aeb6bc0fb2eba518af5438230ff20de41caa365d44a541de61cc4948b28fdc"},
+	}
+
+	salt := make([]byte, veritySaltSize)
+
+	for _, test := range tests {
+		tree, root, err := buildVerityTree(bytes.NewReader(getVerityTestData(test.datablocks)), test.datablocks, salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(tree) != test.treesize {
+			t.Errorf("tree of %v blocks has %v bytes, expected %v", test.datablocks, len(tree), test.treesize)
+		}
+		if hex.EncodeToString(root) != test.roothash {
+			t.Errorf("root hash of %v blocks = %x, expected %v", test.datablocks, root, test.roothash)
+		}
+
+		// The root block sits at the start of the hash device and hashes to the root hash
+		if !bytes.Equal(getVerityDigest(salt, tree[:verityBlockSize]), root) {
+			t.Errorf("root block of %v blocks does not hash to the root hash", test.datablocks)
+		}
+	}
+}
+
+func TestBuildVerityTreeSingleBlock(t *testing.T) {
+	// The kernel compares a lone data block with the root hash directly
+	data := getVerityTestData(1)
+	salt := []byte("salt")
+
+	tree, root, err := buildVerityTree(bytes.NewReader(data), 1, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := sha256.Sum256(append(append([]byte{}, salt...), data...))
+
+	if len(tree) != 0 {
+		t.Errorf("tree has %v bytes, expected none", len(tree))
+	}
+	if !bytes.Equal(root, expected[:]) {
+		t.Errorf("root hash = %x, expected %x", root, expected)
+	}
+}
+
+func TestBuildVerityTreeShortRead(t *testing.T) {
+	if _, _, err := buildVerityTree(bytes.NewReader(getVerityTestData(2)), 3, nil); err == nil {
+		t.Fatal("built a tree over missing data blocks")
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
 	"os"
 	"strings"
 
@@ -24,3 +27,28 @@ func checkFSAvailable(fstype string) error {
 
 	return errors.Errorf("not supported %v filesystem", fstype)
 }
+
+func getImageSize(devpath string) (uint64, error) {
+	f, err := os.Open(devpath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	sb := make([]byte, 2048)
+	if _, err := io.ReadFull(f, sb); err != nil {
+		return 0, err
+	}
+
+	// squashfs keeps the image length in bytes_used
+	if bytes.Equal(sb[0:4], []byte("hsqs")) {
+		return binary.LittleEndian.Uint64(sb[40:48]), nil
+	}
+
+	// erofs keeps the block count and block size bits in the superblock at 1024
+	if binary.LittleEndian.Uint32(sb[1024:1028]) == 0xe0f5e1e2 {
+		return uint64(binary.LittleEndian.Uint32(sb[1060:1064])) << sb[1036], nil
+	}
+
+	return 0, errors.New("not supported image superblock")
+}
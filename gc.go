@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/docker/docker/pkg/system"
+)
+
+const (
+	gcOff    = "off"
+	gcDryRun = "dryrun"
+	gcOn     = "on"
+)
+
+func (d *overlitDriver) collect(id, garbage string, dryrun bool, remove func() error) string {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+
+	if dryrun {
+		return fmt.Sprintf("%v: %v", id, garbage)
+	}
+
+	if err := remove(); err != nil {
+		return fmt.Sprintf("%v: %v (failed: %v)", id, garbage, err)
+	}
+
+	return fmt.Sprintf("%v: %v (removed)", id, garbage)
+}
+
+func (d *overlitDriver) isIncompleteHome(id string) bool {
+	dir := d.getHomePath(id)
+
+	if _, err := os.Stat(dir); err != nil {
+		return false
+	}
+
+	// Homes are complete once createSubDir wrote the link file
+	if _, err := os.Stat(d.getLinkPath(dir)); os.IsNotExist(err) {
+		return true
+	}
+
+	// Unpacked tarballs without a device are left by a layer build that failed
+	tars, _ := ioutil.ReadDir(d.getTarsPath(dir))
+
+	return len(tars) > 0 && d.dmtool.HasDevice(id) != nil
+}
+
+func (d *overlitDriver) gc(dryrun bool) ([]string, error) {
+	garbages := []string{}
+
+	orphans, err := d.dmtool.GetOrphanDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range orphans {
+		garbages = append(garbages, d.collect(name, "device is not recorded in json config", dryrun, func() error {
+			return d.dmtool.RemoveOrphanDevice(name)
+		}))
+	}
+
+	for _, name := range d.dmtool.GetDevices() {
+		if _, err := os.Stat(d.getHomePath(name)); !os.IsNotExist(err) {
+			continue
+		}
+
+		// The reaper and the reclaimer finish these on their own
+		if removing, _ := d.dmtool.GetDeviceRemoving(name); removing {
+			continue
+		}
+
+		garbages = append(garbages, d.collect(name, "device has no layer home", dryrun, func() error {
+			if mntpath, err := d.dmtool.GetDeviceMntPath(name); err == nil && mntpath != "" {
+				mount.RecursiveUnmount(mntpath)
+			}
+
+			return d.dmtool.DeleteDevice(name)
+		}))
+	}
+
+	homes, err := ioutil.ReadDir(d.home)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, home := range homes {
+		id := home.Name()
+
+		if !home.IsDir() || id == linkDir || id == keysDir || !d.isIncompleteHome(id) {
+			continue
+		}
+
+		garbages = append(garbages, d.collect(id, "layer home is incomplete", dryrun, func() error {
+			// The layer may have been finished while we waited for its lock
+			if !d.isIncompleteHome(id) {
+				return nil
+			}
+
+			return system.EnsureRemoveAll(d.getHomePath(id))
+		}))
+	}
+
+	links, err := ioutil.ReadDir(path.Join(d.home, linkDir))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, link := range links {
+		linkPath := path.Join(d.home, linkDir, link.Name())
+
+		target, err := os.Readlink(linkPath)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(path.Join(d.home, linkDir, target)); !os.IsNotExist(err) {
+			continue
+		}
+
+		// Links point to ../<id>/diff, so the layer lock covers them too
+		id := strings.Split(strings.TrimPrefix(target, "../"), "/")[0]
+
+		garbages = append(garbages, d.collect(id, fmt.Sprintf("%v link is dangling", link.Name()), dryrun, func() error {
+			return os.Remove(linkPath)
+		}))
+	}
+
+	if !dryrun {
+		if err := d.dmtool.Flush(); err != nil {
+			return garbages, err
+		}
+	}
+
+	return garbages, nil
+}
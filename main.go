@@ -17,7 +17,17 @@ const (
 func main() {
 	var devName string
 	var groupName string
+	var groupQuota string
 	var extentSize string
+	var allocator string
+	var policy string
+	var growInterval string
+	var fsck string
+	var gc string
+	var dmPrefix string
+	var verity bool
+	var verityTrust string
+	var verityStrict bool
 	var rofsType string
 	var rofsOpts string
 	var rofsRate float64
@@ -28,28 +38,74 @@ func main() {
 	var rwfsMkfsOpts string
 	var rwfsMntOpts string
 	var rwfsSize string
+	var rwfsCrypt string
+	var rwfsIntegrity string
+	var keyProvider string
+	var reclaim string
+	var cacheDev string
+	var cacheMode string
+	var cachePolicy string
+	var cacheSize string
+	var udev string
 	var pushTar bool
 
-	flag.StringVar(&devName, "devname", "_", "devmapper device name")
-	flag.StringVar(&groupName, "groupname", "docker", "devmapper group name")
+	flag.StringVar(&devName, "devname", "_", "devmapper device names (comma separated)")
+	flag.StringVar(&groupName, "groupname", "docker", "devmapper group name (a quota within this pool, backing devices are never shared between instances)")
+	flag.StringVar(&groupQuota, "groupquota", "", "devmapper group quota (0 for unlimited, empty to keep the current one)")
 	flag.StringVar(&extentSize, "extentsize", "4M", "devmapper extent size")
+	flag.StringVar(&allocator, "allocator", "linear", "devmapper allocator (linear or thin)")
+	flag.StringVar(&policy, "policy", "firstfit", "extent allocation policy (firstfit, bestfit, largest or rofront)")
+	flag.StringVar(&growInterval, "growinterval", "0s", "interval to check backing devices for growth (0 to disable)")
+	flag.StringVar(&fsck, "fsck", "check", "consistency check at startup (off, check or repair)")
+	flag.StringVar(&gc, "gc", "off", "garbage collection at startup (off, dryrun or on)")
+	flag.StringVar(&dmPrefix, "dmprefix", "", "devmapper device name prefix (overlit-<groupname>- by default)")
+	flag.BoolVar(&verity, "verity", false, "protect read-only layers with dm-verity")
+	flag.StringVar(&verityTrust, "veritytrust", "", "directory of trusted public keys for signed root hashes")
+	flag.BoolVar(&verityStrict, "veritystrict", false, "reject layers without a trusted signed root hash")
 	flag.StringVar(&rofsType, "rofstype", "raonfs", "filesystem type for read-only layer")
 	flag.StringVar(&rofsOpts, "rofsopts", "", "filesystem options for read-only layer")
 	flag.Float64Var(&rofsRate, "rofsrate", 1.8, "filesystem rate for read-only layer")
 	flag.StringVar(&rofsSize, "rofssize", "0", "filesystem minimum size for read-only layer")
-	flag.StringVar(&rofsCmd0, "rofscmd0", "mkraonfs.py,-s,{tars},-t,{dev}", "precommands for read-only layer")
+	flag.StringVar(&rofsCmd0, "rofscmd0", "mkraonfs.py,-s,{tars},-t,{image}", "precommands for read-only layer ({image} names a file the device is sized to, {size} a file for the built image size)")
 	flag.StringVar(&rofsCmd1, "rofscmd1", "", "postcommands for read-only layer")
 	flag.StringVar(&rwfsType, "rwfstype", "", "filesystem type for read-write layer")
 	flag.StringVar(&rwfsMkfsOpts, "rwfsmkfsopts", "", "filesystem mkfs options for read-write layer")
 	flag.StringVar(&rwfsMntOpts, "rwfsmntopts", "", "filesystem mount options for read-write layer")
 	flag.StringVar(&rwfsSize, "rwfssize", "", "filesystem size for read-write layer")
+	flag.StringVar(&rwfsCrypt, "rwfscrypt", "", "dm-crypt cipher for read-write layer (e.g. aes-xts-plain64)")
+	flag.StringVar(&rwfsIntegrity, "rwfsintegrity", "", "dm-integrity hash for read-write layer (e.g. crc32c)")
+	flag.StringVar(&reclaim, "reclaim", "none", "reclaim policy for extents of deleted devices (none, discard, zero or secure)")
+	flag.StringVar(&cacheDev, "cachedev", "", "fast device to cache layers on")
+	flag.StringVar(&cacheMode, "cachemode", "writecache", "cache target for read-write layers (writecache or cache)")
+	flag.StringVar(&cachePolicy, "cachepolicy", "rw", "layers to cache (rw, hot or all)")
+	flag.StringVar(&cacheSize, "cachesize", "1G", "cache size for each layer")
+	flag.StringVar(&udev, "udev", "auto", "device node management (auto, on or off)")
+	flag.StringVar(&keyProvider, "keyprovider", "", "key provider for read-write layer (file:<dir>, keyring or service:<socket>, keyring keys are lost at reboot)")
 	flag.BoolVar(&pushTar, "pushtar", true, "push layer as tarball")
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		if err := runAdmin(getAdminAddr(groupName, dmPrefix), flag.Arg(0), flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	options := []string{}
 	options = append(options, fmt.Sprintf("devname=%s", devName))
 	options = append(options, fmt.Sprintf("groupname=%s", groupName))
+	options = append(options, fmt.Sprintf("groupquota=%s", groupQuota))
 	options = append(options, fmt.Sprintf("extentsize=%s", extentSize))
+	options = append(options, fmt.Sprintf("allocator=%s", allocator))
+	options = append(options, fmt.Sprintf("policy=%s", policy))
+	options = append(options, fmt.Sprintf("growinterval=%s", growInterval))
+	options = append(options, fmt.Sprintf("fsck=%s", fsck))
+	options = append(options, fmt.Sprintf("gc=%s", gc))
+	options = append(options, fmt.Sprintf("dmprefix=%s", dmPrefix))
+	options = append(options, fmt.Sprintf("verity=%t", verity))
+	options = append(options, fmt.Sprintf("veritytrust=%s", verityTrust))
+	options = append(options, fmt.Sprintf("veritystrict=%t", verityStrict))
 	options = append(options, fmt.Sprintf("rofstype=%s", rofsType))
 	options = append(options, fmt.Sprintf("rofsopts=%s", rofsOpts))
 	options = append(options, fmt.Sprintf("rofsrate=%f", rofsRate))
@@ -60,6 +116,15 @@ func main() {
 	options = append(options, fmt.Sprintf("rwfsmkfsopts=%s", rwfsMkfsOpts))
 	options = append(options, fmt.Sprintf("rwfsmntopts=%s", rwfsMntOpts))
 	options = append(options, fmt.Sprintf("rwfssize=%s", rwfsSize))
+	options = append(options, fmt.Sprintf("rwfscrypt=%s", rwfsCrypt))
+	options = append(options, fmt.Sprintf("rwfsintegrity=%s", rwfsIntegrity))
+	options = append(options, fmt.Sprintf("keyprovider=%s", keyProvider))
+	options = append(options, fmt.Sprintf("reclaim=%s", reclaim))
+	options = append(options, fmt.Sprintf("cachedev=%s", cacheDev))
+	options = append(options, fmt.Sprintf("cachemode=%s", cacheMode))
+	options = append(options, fmt.Sprintf("cachepolicy=%s", cachePolicy))
+	options = append(options, fmt.Sprintf("cachesize=%s", cacheSize))
+	options = append(options, fmt.Sprintf("udev=%s", udev))
 	options = append(options, fmt.Sprintf("pushtar=%t", pushTar))
 
 	d, err := NewOverlitDriver(options)
@@ -68,6 +133,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	go func() {
+		if err := d.ServeAdmin(getAdminAddr(groupName, dmPrefix)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+
 	h := graphhelper.NewHandler(d)
 	h.ServeUnix(fmt.Sprintf(sockAddr, driverName), 0)
 }
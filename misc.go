@@ -1,9 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"syscall"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 const blkGetSize64 = 0x80081272
@@ -24,6 +27,15 @@ func getMaxUint64(a, b uint64) uint64 {
 	return b
 }
 
+func getDeviceNumber(devpath string) string {
+	st := syscall.Stat_t{}
+	if err := syscall.Stat(devpath, &st); err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%v:%v", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)))
+}
+
 func getDeviceSize(devpath string) uint64 {
 	dev, err := os.Open(devpath)
 	if err != nil {
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,6 +15,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/daemon/graphdriver"
 	"github.com/docker/docker/pkg/archive"
@@ -38,39 +40,79 @@ import (
 const (
 	driverName = "overlit"
 	linkDir    = "l"
+	keysDir    = "keys"
 	diffDir    = "diff"
 	tarsDir    = "tars"
 	linkFile   = "link"
 	lowerFile  = "lower"
+	sizeFile   = "size"
+	imageFile  = "image"
 	workDir    = "work"
 	mergedDir  = "merged"
 	configFile = "dmtool.json"
 	maxDepth   = 128
 	idLength   = 26
+
+	reapInterval = 5 * time.Second
+)
+
+const (
+	// Committed image layers can not be changed nor used to smuggle devices or setuid binaries
+	rofsMntFlags = unix.MS_RDONLY | unix.MS_NODEV | unix.MS_NOSUID
 )
 
 const (
 	packedImage = iota
 	raonFsImage
+	signedRaonFsImage
 )
 
 var pageSize int = 4096
 
 type overlitOptions struct {
-	DevName      string
-	GroupName    string
-	ExtentSize   uint64
-	RofsType     string
-	RofsOpts     string
-	RofsRate     float64
-	RofsSize     uint64
-	RofsCmd0     string
-	RofsCmd1     string
-	RwfsType     string
-	RwfsMkfsOpts string
-	RwfsMntOpts  string
-	RwfsSize     uint64
-	PushTar      bool
+	DevName       string
+	GroupName     string
+	GroupQuota    *uint64
+	ExtentSize    uint64
+	Allocator     string
+	Policy        string
+	GrowInterval  time.Duration
+	Fsck          string
+	GC            string
+	DmPrefix      string
+	Verity        bool
+	VerityTrust   string
+	VerityStrict  bool
+	RofsType      string
+	RofsOpts      string
+	RofsRate      float64
+	RofsSize      uint64
+	RofsCmd0      string
+	RofsCmd1      string
+	RwfsType      string
+	RwfsMkfsOpts  string
+	RwfsMntOpts   string
+	RwfsSize      uint64
+	RwfsCrypt     string
+	RwfsIntegrity string
+	KeyProvider   string
+	Reclaim       string
+	CacheDev      string
+	CacheMode     string
+	CachePolicy   string
+	CacheSize     uint64
+	Udev          string
+	PushTar       bool
+}
+
+type rwfsOptions struct {
+	FsType    string
+	MkfsOpts  string
+	MntOpts   string
+	FsSize    uint64
+	Crypt     string
+	Integrity string
+	GroupName string
 }
 
 type overlitDriver struct {
@@ -84,7 +126,11 @@ type overlitDriver struct {
 	ctr    *graphdriver.RefCounter
 	locker *locker.Locker
 
+	trust []crypto.PublicKey
+
 	dmtool *DmTool
+
+	stop chan struct{}
 }
 
 func init() {
@@ -108,9 +154,44 @@ func parseOptions(options []string) (*overlitOptions, error) {
 			opts.DevName = val
 		case "groupname":
 			opts.GroupName = val
+		case "groupquota":
+			// Without a configured quota the one set through the admin socket stays
+			if val != "" {
+				size, _ := units.RAMInBytes(val)
+				quota := uint64(size)
+				opts.GroupQuota = &quota
+			}
 		case "extentsize":
 			size, _ := units.RAMInBytes(val)
 			opts.ExtentSize = uint64(size)
+		case "allocator":
+			opts.Allocator = val
+		case "policy":
+			opts.Policy = val
+		case "growinterval":
+			interval, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not parse grow interval (%s)", val)
+			}
+			opts.GrowInterval = interval
+		case "fsck":
+			if val != fsckOff && val != fsckCheck && val != fsckRepair {
+				return nil, errors.Errorf("not supported fsck mode (%s)", val)
+			}
+			opts.Fsck = val
+		case "gc":
+			if val != gcOff && val != gcDryRun && val != gcOn {
+				return nil, errors.Errorf("not supported gc mode (%s)", val)
+			}
+			opts.GC = val
+		case "dmprefix":
+			opts.DmPrefix = val
+		case "verity":
+			opts.Verity, _ = strconv.ParseBool(val)
+		case "veritytrust":
+			opts.VerityTrust = val
+		case "veritystrict":
+			opts.VerityStrict, _ = strconv.ParseBool(val)
 		case "rofstype":
 			opts.RofsType = val
 		case "rofsopts":
@@ -133,6 +214,42 @@ func parseOptions(options []string) (*overlitOptions, error) {
 		case "rwfssize":
 			size, _ := units.RAMInBytes(val)
 			opts.RwfsSize = uint64(size)
+		case "rwfscrypt":
+			if val != "" {
+				if err := checkCryptCipher(val); err != nil {
+					return nil, err
+				}
+			}
+			opts.RwfsCrypt = val
+		case "rwfsintegrity":
+			opts.RwfsIntegrity = val
+		case "keyprovider":
+			opts.KeyProvider = val
+		case "reclaim":
+			if val != reclaimNone && val != reclaimDiscard && val != reclaimZero && val != reclaimSecure {
+				return nil, errors.Errorf("not supported reclaim policy (%s)", val)
+			}
+			opts.Reclaim = val
+		case "cachedev":
+			opts.CacheDev = val
+		case "cachemode":
+			if val != cacheModeWriteCache && val != cacheModeCache {
+				return nil, errors.Errorf("not supported cache mode (%s)", val)
+			}
+			opts.CacheMode = val
+		case "cachepolicy":
+			if val != cachePolicyRW && val != cachePolicyHot && val != cachePolicyAll {
+				return nil, errors.Errorf("not supported cache policy (%s)", val)
+			}
+			opts.CachePolicy = val
+		case "cachesize":
+			size, _ := units.RAMInBytes(val)
+			opts.CacheSize = uint64(size)
+		case "udev":
+			if val != udevAuto && val != udevOn && val != udevOff {
+				return nil, errors.Errorf("not supported udev mode (%s)", val)
+			}
+			opts.Udev = val
 		case "pushtar":
 			opts.PushTar, _ = strconv.ParseBool(val)
 		default:
@@ -143,37 +260,56 @@ func parseOptions(options []string) (*overlitOptions, error) {
 	return opts, nil
 }
 
-func parseRWFSOptions(overlitOpts overlitOptions, storageOpts map[string]string) (fstype, mkfsopts, mntopts string, fssize uint64, rerr error) {
-	fstype = overlitOpts.RwfsType
-	mkfsopts = overlitOpts.RwfsMkfsOpts
-	mntopts = overlitOpts.RwfsMntOpts
-	fssize = overlitOpts.RwfsSize
+func parseRWFSOptions(overlitOpts overlitOptions, storageOpts map[string]string) (*rwfsOptions, error) {
+	opts := &rwfsOptions{
+		FsType:    overlitOpts.RwfsType,
+		MkfsOpts:  overlitOpts.RwfsMkfsOpts,
+		MntOpts:   overlitOpts.RwfsMntOpts,
+		FsSize:    overlitOpts.RwfsSize,
+		Crypt:     overlitOpts.RwfsCrypt,
+		Integrity: overlitOpts.RwfsIntegrity,
+		GroupName: overlitOpts.GroupName,
+	}
 
 	for key, val := range storageOpts {
 		key = strings.ToLower(key)
 		switch key {
 		case "rwfstype":
 			if val == "_" {
-				return "", "", "", 0, nil
+				return &rwfsOptions{}, nil
 			}
 			// Check if read-write filesystem is available
 			if err := checkFSAvailable(val); err != nil {
-				return "", "", "", 0, err
+				return nil, err
 			}
-			fstype = val
+			opts.FsType = val
 		case "rwfsmkfsopts":
-			mkfsopts = val
+			opts.MkfsOpts = val
 		case "rwfsmntopts":
-			mntopts = val
+			opts.MntOpts = val
 		case "rwfssize":
 			size, _ := units.RAMInBytes(val)
-			fssize = uint64(size)
+			opts.FsSize = uint64(size)
+		case "rwfscrypt":
+			if val == "_" {
+				val = ""
+			} else if err := checkCryptCipher(val); err != nil {
+				return nil, err
+			}
+			opts.Crypt = val
+		case "rwfsintegrity":
+			if val == "_" {
+				val = ""
+			}
+			opts.Integrity = val
+		case "groupname":
+			opts.GroupName = val
 		default:
-			return "", "", "", 0, errors.Errorf("not supported option (%s = %s)", key, val)
+			return nil, errors.Errorf("not supported option (%s = %s)", key, val)
 		}
 	}
 
-	return
+	return opts, nil
 }
 
 func getGDHelperChanges(_changes []archive.Change) ([]gdhelper.Change, error) {
@@ -199,6 +335,15 @@ func getAbsPaths(dir string, _paths []string) []string {
 	return paths
 }
 
+func getDmPrefix(groupname, dmprefix string) string {
+	// Instances with different groups can share the host without name clashes
+	if dmprefix == "" {
+		return fmt.Sprintf("%v-%v-", driverName, groupname)
+	}
+
+	return dmprefix
+}
+
 func (d *overlitDriver) getHomePath(id string) string {
 	return path.Join(d.home, id)
 }
@@ -219,6 +364,14 @@ func (d *overlitDriver) getLowerPath(home string) string {
 	return path.Join(home, lowerFile)
 }
 
+func (d *overlitDriver) getSizePath(home string) string {
+	return path.Join(home, sizeFile)
+}
+
+func (d *overlitDriver) getImagePath(home string) string {
+	return path.Join(home, imageFile)
+}
+
 func (d *overlitDriver) getWorkPath(home string) string {
 	return path.Join(home, workDir)
 }
@@ -228,7 +381,7 @@ func (d *overlitDriver) getMergedPath(home string) string {
 }
 
 func (d *overlitDriver) getDevPath(id string) string {
-	return path.Join("/dev/mapper", id)
+	return d.dmtool.GetDevicePath(id)
 }
 
 func (d *overlitDriver) getRootIdentity() (idtools.Identity, int, int, error) {
@@ -259,6 +412,50 @@ func (d *overlitDriver) execCommands(cmds string) error {
 	return nil
 }
 
+func (d *overlitDriver) getImageSize(sizePath, devPath string) (uint64, error) {
+	// Prefer the size reported by the image builder over the superblock
+	if data, err := ioutil.ReadFile(sizePath); err == nil {
+		os.Remove(sizePath)
+
+		return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+
+	return getImageSize(devPath)
+}
+
+func (d *overlitDriver) writeImage(id, imagePath, devPath string) (uint64, error) {
+	defer os.Remove(imagePath)
+
+	src, err := os.Open(imagePath)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not open built image")
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	imagesize := uint64(fi.Size())
+
+	if err := d.dmtool.ResizeDevice(id, imagesize); err != nil {
+		return 0, err
+	}
+
+	dst, err := os.OpenFile(devPath, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return 0, errors.Wrap(err, "could not copy built image")
+	}
+
+	return imagesize, dst.Sync()
+}
+
 func (d *overlitDriver) createHomeDir(id, parent string, root idtools.Identity) error {
 	dir := d.getHomePath(id)
 
@@ -332,6 +529,10 @@ func (d *overlitDriver) createSubDir(id, parent string, root idtools.Identity) e
 }
 
 func (d *overlitDriver) detectImage(source []byte) int {
+	if isSignedImage(source) {
+		return signedRaonFsImage
+	}
+
 	for image, magic := range map[int][]byte{
 		raonFsImage: {0x52, 0x41, 0x4f, 0x4e},
 	} {
@@ -354,6 +555,7 @@ func (d *overlitDriver) Init(home string, options []string, uidMaps, gidMaps []i
 	d.gidMaps = gidMaps
 	d.ctr = graphdriver.NewRefCounter(graphdriver.NewFsChecker(graphdriver.FsMagicOverlay))
 	d.locker = locker.New()
+	d.stop = make(chan struct{})
 
 	root, _, _, err := d.getRootIdentity()
 	if err != nil {
@@ -363,14 +565,96 @@ func (d *overlitDriver) Init(home string, options []string, uidMaps, gidMaps []i
 		return err
 	}
 
-	if err := d.dmtool.Setup(d.options.DevName, d.options.ExtentSize, fmt.Sprintf("%v/%v", d.home, configFile)); err != nil {
+	if d.options.VerityStrict && d.options.VerityTrust == "" {
+		return errors.New("veritystrict needs veritytrust")
+	}
+
+	// Signatures cover root hashes, which only exist for layers protected by verity
+	if d.options.VerityTrust != "" && !d.options.Verity {
+		return errors.New("veritytrust needs verity")
+	}
+
+	// Hash extents are taken from the backing devices, which a thin pool owns alone
+	if d.options.Verity && d.options.Allocator == thinAllocator {
+		return errors.New("not supported verity on thin allocator")
+	}
+
+	// Integrity metadata comes from the backing devices as well
+	if d.options.RwfsIntegrity != "" {
+		if d.options.Allocator == thinAllocator {
+			return errors.New("not supported integrity on thin allocator")
+		}
+		if _, err := getIntegrityTagSize(d.options.RwfsIntegrity); err != nil {
+			return err
+		}
+	}
+
+	if d.options.VerityTrust != "" {
+		if d.trust, err = loadTrustStore(d.options.VerityTrust); err != nil {
+			return err
+		}
+	}
+
+	if d.options.KeyProvider == "" {
+		d.options.KeyProvider = fmt.Sprintf("file:%v", path.Join(home, keysDir))
+	}
+
+	keyprovider, err := getDmKeyProvider(d.options.KeyProvider)
+	if err != nil {
+		return err
+	}
+
+	dmopts := DmToolOptions{
+		DevPaths:   strings.Split(d.options.DevName, ","),
+		ExtentSize: d.options.ExtentSize,
+		Allocator:  d.options.Allocator,
+		Policy:     d.options.Policy,
+		GroupName:  d.options.GroupName,
+		GroupQuota: d.options.GroupQuota,
+		Prefix:     getDmPrefix(d.options.GroupName, d.options.DmPrefix),
+
+		KeyProvider: keyprovider,
+		Reclaim:     d.options.Reclaim,
+
+		CachePath: d.options.CacheDev,
+		CacheMode: d.options.CacheMode,
+		CacheSize: d.options.CacheSize,
+
+		Udev: d.options.Udev,
+	}
+
+	if err := d.dmtool.Setup(dmopts, fmt.Sprintf("%v/%v", d.home, configFile)); err != nil {
 		return err
 	}
 
 	for devname, device := range d.dmtool.Devices {
+		// Devices on their way out were not activated by Setup
+		if device.Removing || device.Reclaiming {
+			continue
+		}
+
+		// Inactive devices may come back with their key on the next start, so they are not stale
+		if active, _ := d.dmtool.GetDeviceActive(devname); !active {
+			log.Printf("overlit: skip inactive %v device\n", devname)
+			continue
+		}
+
 		devPath := d.getDevPath(devname)
 
-		if err := unix.Mount(devPath, device.MntPath, device.FsType, 0, ""); err != nil {
+		// Layers committed before sealing existed get their read-only table now
+		if device.Readonly && device.FsType != "" && !device.Sealed {
+			if err := d.dmtool.SealDevice(devname, DmSealOptions{}); err != nil {
+				log.Printf("overlit: failed to seal %v device: %v\n", devname, err)
+			}
+		}
+
+		// Finished image layers are mounted like applyTar did, even when sealing them failed
+		flags := uintptr(0)
+		if device.Readonly && device.FsType != "" {
+			flags = rofsMntFlags
+		}
+
+		if err := unix.Mount(devPath, device.MntPath, device.FsType, flags, ""); err != nil {
 			if !os.IsNotExist(err) {
 				return err
 			}
@@ -379,12 +663,137 @@ func (d *overlitDriver) Init(home string, options []string, uidMaps, gidMaps []i
 		}
 	}
 
+	// The reclaimer deletes devices, so it waits until the pass above is done with them
+	d.dmtool.StartReclaim()
+
+	if d.options.Fsck != "" && d.options.Fsck != fsckOff {
+		problems, err := d.fsck(d.options.Fsck == fsckRepair)
+		if err != nil {
+			return err
+		}
+
+		for _, problem := range problems {
+			log.Printf("overlit: fsck %v\n", problem)
+		}
+	}
+
+	if d.options.GC != "" && d.options.GC != gcOff {
+		garbages, err := d.gc(d.options.GC == gcDryRun)
+		if err != nil {
+			return err
+		}
+
+		for _, garbage := range garbages {
+			log.Printf("overlit: gc %v\n", garbage)
+		}
+	}
+
+	d.runPeriodic(reapInterval, func() {
+		if reaped := d.dmtool.ReapDevices(); len(reaped) > 0 {
+			log.Printf("overlit: reap devices (names = %v)\n", reaped)
+
+			if err := d.dmtool.Flush(); err != nil {
+				log.Printf("overlit: failed to flush after reap: %v\n", err)
+			}
+		}
+	})
+
+	if d.options.GrowInterval > 0 {
+		d.runPeriodic(d.options.GrowInterval, func() {
+			if _, err := d.growBackingDevices(); err != nil {
+				log.Printf("overlit: failed to grow backing devices: %v\n", err)
+			}
+		})
+	}
+
 	return nil
 }
 
+func (d *overlitDriver) runPeriodic(interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	stop := d.stop
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (d *overlitDriver) growBackingDevices() ([]string, error) {
+	grown, err := d.dmtool.GrowBackingDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(grown) > 0 {
+		if err := d.dmtool.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	return grown, nil
+}
+
+func (d *overlitDriver) fsck(repair bool) ([]string, error) {
+	problems := []string{}
+
+	dmproblems, err := d.dmtool.Fsck(repair)
+	if err != nil {
+		return nil, err
+	}
+	for _, problem := range dmproblems {
+		problems = append(problems, problem.String())
+	}
+
+	for _, name := range d.dmtool.GetDevices() {
+		// Layers removed while busy lose their home before the reaper gets their device
+		if removing, _ := d.dmtool.GetDeviceRemoving(name); removing {
+			continue
+		}
+
+		if _, err := os.Stat(d.getHomePath(name)); os.IsNotExist(err) {
+			problems = append(problems, fmt.Sprintf("%v: device has no layer home", name))
+		}
+	}
+
+	homes, err := ioutil.ReadDir(d.home)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, home := range homes {
+		id := home.Name()
+
+		if !home.IsDir() || id == linkDir || id == keysDir {
+			continue
+		}
+
+		d.locker.Lock(id)
+		incomplete := d.isIncompleteHome(id)
+		d.locker.Unlock(id)
+
+		if incomplete {
+			problems = append(problems, fmt.Sprintf("%v: layer home is incomplete", id))
+		}
+	}
+
+	return problems, nil
+}
+
 func (d *overlitDriver) Create(id, parent, mountLabel string, storageOpts map[string]string) (rerr error) {
 	log.Printf("overlit: create (id = %s, parent = %s, mountLabel = %s, storageOpts = %v)\n", id, parent, mountLabel, storageOpts)
 
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+
 	dir := d.getHomePath(id)
 
 	root, _, _, err := d.getRootIdentity()
@@ -405,7 +814,7 @@ func (d *overlitDriver) Create(id, parent, mountLabel string, storageOpts map[st
 		return err
 	}
 
-	if err := d.dmtool.CreateDevice(id); err != nil {
+	if err := d.dmtool.CreateDevice(id, d.options.GroupName, DmCreateOptions{}); err != nil {
 		return err
 	}
 
@@ -415,6 +824,9 @@ func (d *overlitDriver) Create(id, parent, mountLabel string, storageOpts map[st
 func (d *overlitDriver) CreateReadWrite(id, parent, mountLabel string, storageOpts map[string]string) (rerr error) {
 	log.Printf("overlit: createreadwrite (id = %s, parent = %s, mountLabel = %s, storageOpts = %v)\n", id, parent, mountLabel, storageOpts)
 
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+
 	dir := d.getHomePath(id)
 
 	root, _, _, err := d.getRootIdentity()
@@ -431,18 +843,18 @@ func (d *overlitDriver) CreateReadWrite(id, parent, mountLabel string, storageOp
 		}
 	}()
 
-	fstype, mkfsopts, mntopts, fssize, err := parseRWFSOptions(d.options, storageOpts)
+	rwfs, err := parseRWFSOptions(d.options, storageOpts)
 	if err != nil {
 		return err
-	} else if fstype == "tmpfs" {
-		if err := unix.Mount("tmpfs", dir, fstype, 0, fmt.Sprintf("size=%v", fssize)); err != nil {
+	} else if rwfs.FsType == "tmpfs" {
+		if err := unix.Mount("tmpfs", dir, rwfs.FsType, 0, fmt.Sprintf("size=%v", rwfs.FsSize)); err != nil {
 			return err
 		}
-	} else if fstype != "" {
+	} else if rwfs.FsType != "" {
 		devPath := d.getDevPath(id)
 
-		if err := d.dmtool.CreateDevice(id); err != nil {
-			return errors.New("could not create device")
+		if err := d.dmtool.CreateDevice(id, rwfs.GroupName, DmCreateOptions{Cipher: rwfs.Crypt, Integrity: rwfs.Integrity}); err != nil {
+			return errors.Wrap(err, "could not create device")
 		}
 		defer func() {
 			if rerr != nil {
@@ -450,19 +862,26 @@ func (d *overlitDriver) CreateReadWrite(id, parent, mountLabel string, storageOp
 			}
 		}()
 
-		if err := d.dmtool.ResizeDevice(id, fssize); err != nil {
-			return errors.New("could not resize device")
+		if err := d.dmtool.ResizeDevice(id, rwfs.FsSize); err != nil {
+			return errors.Wrap(err, "could not resize device")
 		}
 
-		if err := d.execCommands(fmt.Sprintf("mkfs.%v,%v,%v", fstype, devPath, mkfsopts)); err != nil {
+		// Containers run without the cache rather than not at all
+		if d.options.CachePolicy == cachePolicyRW || d.options.CachePolicy == cachePolicyAll {
+			if err := d.dmtool.AttachCache(id); err != nil {
+				log.Printf("overlit: failed to attach cache to %v: %v\n", id, err)
+			}
+		}
+
+		if err := d.execCommands(fmt.Sprintf("mkfs.%v,%v,%v", rwfs.FsType, devPath, rwfs.MkfsOpts)); err != nil {
 			return err
 		}
 
-		if err := unix.Mount(devPath, dir, fstype, 0, mntopts); err != nil {
+		if err := unix.Mount(devPath, dir, rwfs.FsType, 0, rwfs.MntOpts); err != nil {
 			return err
 		}
 
-		if err := d.dmtool.SetDeviceFsType(id, fstype); err != nil {
+		if err := d.dmtool.SetDeviceFsType(id, rwfs.FsType); err != nil {
 			return err
 		}
 
@@ -556,6 +975,11 @@ func (d *overlitDriver) Get(id, mountLabel string) (_ containerfs.ContainerFS, r
 	}()
 
 	lowers := strings.Split(string(lower), ":")
+
+	if d.options.CachePolicy == cachePolicyHot || d.options.CachePolicy == cachePolicyAll {
+		go d.cacheLowers(lowers)
+	}
+
 	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(getAbsPaths(d.home, lowers), ":"), d.getDiffPath(dir), d.getWorkPath(dir))
 	mountData := label.FormatMountLabel(opts, mountLabel)
 	mount := unix.Mount
@@ -593,6 +1017,25 @@ func (d *overlitDriver) Get(id, mountLabel string) (_ containerfs.ContainerFS, r
 	return containerfs.NewLocalContainerFS(mergedPath), nil
 }
 
+func (d *overlitDriver) cacheLowers(lowers []string) {
+	// Image layers become hot once a container runs on them
+	for _, lower := range lowers {
+		lp, err := os.Readlink(path.Join(d.home, lower))
+		if err != nil {
+			continue
+		}
+
+		id := path.Base(path.Dir(lp))
+		if d.dmtool.HasDevice(id) != nil {
+			continue
+		}
+
+		if err := d.dmtool.AttachCache(id); err != nil {
+			log.Printf("overlit: failed to attach cache to %v: %v\n", id, err)
+		}
+	}
+}
+
 func (d *overlitDriver) Put(id string) error {
 	log.Printf("overlit: put (id = %s)\n", id)
 
@@ -640,7 +1083,24 @@ func (d *overlitDriver) Exists(id string) bool {
 func (d *overlitDriver) Status() [][2]string {
 	log.Printf("overlit: status\n")
 
-	return nil
+	reclaim := d.dmtool.GetReclaimStatus()
+	if reclaim.Policy == "" {
+		reclaim.Policy = reclaimNone
+	}
+
+	status := [][2]string{
+		{"Reclaim Policy", reclaim.Policy},
+		{"Reclaim Pending", fmt.Sprintf("%v devices (%v)", reclaim.Devices, units.BytesSize(float64(reclaim.Extents*d.options.ExtentSize)))},
+	}
+
+	if reclaim.Current != "" {
+		status = append(status, [2]string{"Reclaim Progress", fmt.Sprintf("%v (%v/%v extents)", reclaim.Current, reclaim.Done, reclaim.Total)})
+	}
+	if reclaim.Failed > 0 {
+		status = append(status, [2]string{"Reclaim Failed", fmt.Sprintf("%v devices", reclaim.Failed)})
+	}
+
+	return status
 }
 
 func (d *overlitDriver) GetMetadata(id string) (map[string]string, error) {
@@ -673,12 +1133,22 @@ func (d *overlitDriver) GetMetadata(id string) (map[string]string, error) {
 		metadata["LowerDir"] = strings.Join(lowers, ":")
 	}
 
+	if roothash, err := d.dmtool.GetDeviceRootHash(id); err == nil && roothash != "" {
+		metadata["RootHash"] = roothash
+	}
+
 	return metadata, nil
 }
 
 func (d *overlitDriver) Cleanup() error {
 	log.Printf("overlit: cleanup\n")
 
+	// Background work must not touch the pool once it is flushed for the last time
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
+
 	d.dmtool.Cleanup()
 
 	if d.home != "" {
@@ -744,6 +1214,8 @@ func (d *overlitDriver) applyTar(id, parent string, diff io.Reader) (int64, erro
 	dir := d.getHomePath(id)
 	tarsPath := d.getTarsPath(dir)
 	diffPath := d.getDiffPath(dir)
+	sizePath := d.getSizePath(dir)
+	imagePath := d.getImagePath(dir)
 	devPath := d.getDevPath(id)
 
 	options := &archive.TarOptions{
@@ -758,35 +1230,65 @@ func (d *overlitDriver) applyTar(id, parent string, diff io.Reader) (int64, erro
 		return 0, err
 	}
 
-	fssize := uint64(math.Ceil(float64(size) * d.options.RofsRate))
-	fssize = getMaxUint64(fssize, d.options.RofsSize)
-
-	if err := d.dmtool.ResizeDevice(id, fssize); err != nil {
+	// Mark the layer read-only before allocating so the policy can place it
+	if err := d.dmtool.SetDeviceReadonly(id, true); err != nil {
 		return 0, err
 	}
 
 	cmd0 := d.options.RofsCmd0
+
+	// Builders writing an image file get a device of exactly its size afterwards
+	toimage := strings.Contains(cmd0, "{image}")
+
+	if !toimage {
+		fssize := uint64(math.Ceil(float64(size) * d.options.RofsRate))
+		fssize = getMaxUint64(fssize, d.options.RofsSize)
+
+		if err := d.dmtool.ResizeDevice(id, fssize); err != nil {
+			return 0, err
+		}
+	}
+
 	cmd0 = strings.Replace(cmd0, "{tars}", tarsPath, -1)
 	cmd0 = strings.Replace(cmd0, "{diff}", diffPath, -1)
 	cmd0 = strings.Replace(cmd0, "{type}", d.options.RofsType, -1)
 	cmd0 = strings.Replace(cmd0, "{dev}", devPath, -1)
+	cmd0 = strings.Replace(cmd0, "{size}", sizePath, -1)
+	cmd0 = strings.Replace(cmd0, "{image}", imagePath, -1)
 	if err := d.execCommands(cmd0); err != nil {
 		return 0, err
 	}
 
-	if err := unix.Mount(devPath, diffPath, d.options.RofsType, 0, d.options.RofsOpts); err != nil {
-		return 0, err
+	imagesize := uint64(0)
+
+	if toimage {
+		if imagesize, err = d.writeImage(id, imagePath, devPath); err != nil {
+			return 0, err
+		}
+	} else if imagesize, err = d.getImageSize(sizePath, devPath); err == nil {
+		// Give back the extents the image does not use
+		if err := d.dmtool.ResizeDevice(id, imagesize); err != nil {
+			return 0, err
+		}
+	} else {
+		log.Printf("overlit: could not get image size of %v: %v\n", id, err)
 	}
 
-	if err := d.dmtool.SetDeviceFsType(id, d.options.RofsType); err != nil {
+	if imagesize > 0 {
+		if err := d.dmtool.SetDeviceImageSize(id, imagesize); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := unix.Mount(devPath, diffPath, d.options.RofsType, rofsMntFlags, d.options.RofsOpts); err != nil {
 		return 0, err
 	}
 
-	if err := d.dmtool.SetDeviceMntPath(id, diffPath); err != nil {
+	if err := d.dmtool.SetDeviceFsType(id, d.options.RofsType); err != nil {
 		return 0, err
 	}
 
-	if err := d.dmtool.SetDeviceReadonly(id, true); err != nil {
+	if err := d.dmtool.SetDeviceMntPath(id, diffPath); err != nil {
 		return 0, err
 	}
 
@@ -802,10 +1304,32 @@ func (d *overlitDriver) applyTar(id, parent string, diff io.Reader) (int64, erro
 		return 0, err
 	}
 
+	if err := d.dmtool.SealDevice(id, DmSealOptions{Verity: d.options.Verity}); err != nil {
+		return 0, errors.Wrap(err, "could not seal device")
+	}
+
 	return size, nil
 }
 
-func (d *overlitDriver) applyRaonFS(id, parent string, diff io.Reader) (int64, error) {
+func (d *overlitDriver) verifySignature(id, roothash string, signature []byte) error {
+	// The root hash comes from the tree built over what we received, so a valid signature covers the data
+	err := errors.Errorf("%v layer is not signed (roothash = %v)", id, roothash)
+	if signature != nil {
+		err = (&layerSignature{RootHash: roothash, Signature: signature}).verify(d.trust)
+	}
+
+	if err != nil {
+		if d.options.VerityStrict {
+			return err
+		}
+
+		log.Printf("overlit: ignore signature of %v: %v\n", id, err)
+	}
+
+	return nil
+}
+
+func (d *overlitDriver) applyRaonFS(id, parent string, diff io.Reader, signature []byte) (int64, error) {
 	log.Printf("overlit: applyraonfs (id = %s, parent = %s)\n", id, parent)
 
 	dir := d.getHomePath(id)
@@ -823,6 +1347,10 @@ func (d *overlitDriver) applyRaonFS(id, parent string, diff io.Reader) (int64, e
 	r := bufio.NewReader(diff)
 	w := bufio.NewWriter(t)
 
+	if err := d.dmtool.SetDeviceReadonly(id, true); err != nil {
+		return 0, err
+	}
+
 	buf := make([]byte, d.options.ExtentSize)
 	for {
 		n, err := r.Read(buf)
@@ -848,19 +1376,45 @@ func (d *overlitDriver) applyRaonFS(id, parent string, diff io.Reader) (int64, e
 		return 0, err
 	}
 
-	if err := unix.Mount(devPath, diffPath, d.options.RofsType, 0, d.options.RofsOpts); err != nil {
+	// Verity hashes whole blocks, so the last one is padded with zeros like veritysetup reads the image file
+	if pad := (verityBlockSize - size%verityBlockSize) % verityBlockSize; pad > 0 {
+		if _, err := t.WriteAt(make([]byte, pad), size); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := d.dmtool.ResizeDevice(id, uint64(size)); err != nil {
 		return 0, err
 	}
 
-	if err := d.dmtool.SetDeviceFsType(id, d.options.RofsType); err != nil {
+	if err := d.dmtool.SetDeviceImageSize(id, uint64(size)); err != nil {
 		return 0, err
 	}
 
-	if err := d.dmtool.SetDeviceMntPath(id, diffPath); err != nil {
+	// Publishers can only reproduce the root hash of a tree built without a random salt
+	sealopts := DmSealOptions{Verity: d.options.Verity}
+	if d.options.VerityTrust != "" {
+		sealopts.Salt = verityNoSalt
+		sealopts.Verify = func(roothash string) error {
+			return d.verifySignature(id, roothash, signature)
+		}
+	}
+
+	// A layer that failed its signature must not come back on the next start either
+	if err := d.dmtool.SealDevice(id, sealopts); err != nil {
+		d.dmtool.DeleteDevice(id)
+		return 0, errors.Wrap(err, "could not seal device")
+	}
+
+	if err := unix.Mount(devPath, diffPath, d.options.RofsType, rofsMntFlags, d.options.RofsOpts); err != nil {
 		return 0, err
 	}
 
-	if err := d.dmtool.SetDeviceReadonly(id, true); err != nil {
+	if err := d.dmtool.SetDeviceFsType(id, d.options.RofsType); err != nil {
+		return 0, err
+	}
+
+	if err := d.dmtool.SetDeviceMntPath(id, diffPath); err != nil {
 		return 0, err
 	}
 
@@ -874,9 +1428,12 @@ func (d *overlitDriver) applyRaonFS(id, parent string, diff io.Reader) (int64, e
 func (d *overlitDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
 	log.Printf("overlit: applydiff (id = %s, parent = %s)\n", id, parent)
 
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+
 	p := pools.BufioReader32KPool
 	buf := p.Get(diff)
-	bs, err := buf.Peek(10)
+	bs, err := buf.Peek(512)
 	if err != nil && err != io.EOF {
 		return 0, err
 	}
@@ -884,9 +1441,21 @@ func (d *overlitDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, err
 	image := d.detectImage(bs)
 	switch image {
 	case packedImage:
+		// Tarballs carry no signature, so a strict policy only takes signed raonfs streams
+		if d.options.VerityStrict {
+			return 0, errors.Errorf("%v layer is not signed", id)
+		}
+
 		return d.applyTar(id, parent, p.NewReadCloserWrapper(buf, buf))
 	case raonFsImage:
-		return d.applyRaonFS(id, parent, p.NewReadCloserWrapper(buf, buf))
+		return d.applyRaonFS(id, parent, p.NewReadCloserWrapper(buf, buf), nil)
+	case signedRaonFsImage:
+		signature, image, err := readSignedImage(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		return d.applyRaonFS(id, parent, image, signature)
 	}
 
 	return 0, err
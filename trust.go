@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Signed layers come as a tar of the detached signature followed by the raonfs image
+	signatureEntry = "raonfs.sig"
+	imageEntry     = "raonfs"
+
+	maxSignatureSize = 64 * 1024
+)
+
+type layerSignature struct {
+	RootHash  string
+	Signature []byte
+}
+
+func loadTrustStore(dir string) ([]crypto.PublicKey, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read trust store")
+	}
+
+	keys := []crypto.PublicKey{}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			switch block.Type {
+			case "PUBLIC KEY":
+				key, err := x509.ParsePKIXPublicKey(block.Bytes)
+				if err != nil {
+					return nil, errors.Wrapf(err, "could not parse public key in %v", file.Name())
+				}
+				keys = append(keys, key)
+			case "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, errors.Wrapf(err, "could not parse certificate in %v", file.Name())
+				}
+				keys = append(keys, cert.PublicKey)
+			}
+		}
+	}
+
+	log.Printf("overlit: load trust store (dir = %v, keys = %v)\n", dir, len(keys))
+
+	return keys, nil
+}
+
+func (s *layerSignature) verify(keys []crypto.PublicKey) error {
+	// Publishers sign the hex root hash of the image hashed without a salt (veritysetup --salt=-)
+	message := []byte(s.RootHash)
+	digest := sha256.Sum256(message)
+
+	for _, key := range keys {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], s.Signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(key, digest[:], s.Signature) {
+				return nil
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(key, message, s.Signature) {
+				return nil
+			}
+		}
+	}
+
+	return errors.Errorf("%v root hash is not signed by a trusted key", s.RootHash)
+}
+
+func isSignedImage(source []byte) bool {
+	// The name of the first tar entry fills the front of its header, the ustar magic follows at 257
+	if len(source) < 512 || !bytes.HasPrefix(source[257:], []byte("ustar")) {
+		return false
+	}
+
+	return string(bytes.TrimRight(source[:100], "\x00")) == signatureEntry
+}
+
+func readSignedImage(r io.Reader) ([]byte, io.Reader, error) {
+	tr := tar.NewReader(r)
+
+	header, err := tr.Next()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not read signed layer")
+	}
+	if header.Name != signatureEntry || header.Size > maxSignatureSize {
+		return nil, nil, errors.Errorf("has no %v entry", signatureEntry)
+	}
+
+	signature, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not read signature")
+	}
+
+	header, err = tr.Next()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not read signed layer")
+	}
+	if header.Name != imageEntry {
+		return nil, nil, errors.Errorf("has no %v entry", imageEntry)
+	}
+
+	return signature, tr, nil
+}
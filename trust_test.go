@@ -0,0 +1,229 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+const testRootHash = "e5aeb6bc0fb2eba518af5438230ff20de41caa365d44a541de61cc4948b28fdc"
+
+type testSigner struct {
+	name   string
+	public crypto.PublicKey
+	sign   func(message []byte) []byte
+}
+
+func getTestSigners(t *testing.T) []testSigner {
+	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsakey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edpublic, edprivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signatures are what openssl dgst -sha256 -sign (or pkeyutl -sign for ed25519) writes for the root hash
+	return []testSigner{
+		{"rsa", &rsakey.PublicKey, func(message []byte) []byte {
+			digest := sha256.Sum256(message)
+			signature, err := rsa.SignPKCS1v15(rand.Reader, rsakey, crypto.SHA256, digest[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return signature
+		}},
+		{"ecdsa", &ecdsakey.PublicKey, func(message []byte) []byte {
+			digest := sha256.Sum256(message)
+			signature, err := ecdsa.SignASN1(rand.Reader, ecdsakey, digest[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return signature
+		}},
+		{"ed25519", edpublic, func(message []byte) []byte {
+			return ed25519.Sign(edprivate, message)
+		}},
+	}
+}
+
+func writeTestPEM(t *testing.T, filepath, blocktype string, data []byte) {
+	if err := ioutil.WriteFile(filepath, pem.EncodeToMemory(&pem.Block{Type: blocktype, Bytes: data}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadTrustStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, signer := range getTestSigners(t) {
+		data, err := x509.MarshalPKIXPublicKey(signer.public)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writeTestPEM(t, path.Join(dir, signer.name+".pem"), "PUBLIC KEY", data)
+	}
+
+	certkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "publisher"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &certkey.PublicKey, certkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestPEM(t, path.Join(dir, "publisher.crt"), "CERTIFICATE", cert)
+
+	// Files without keys are skipped
+	if err := ioutil.WriteFile(path.Join(dir, "README"), []byte("trusted publishers\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := loadTrustStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 4 {
+		t.Fatalf("loaded %v keys, expected 4", len(keys))
+	}
+
+	writeTestPEM(t, path.Join(dir, "broken.pem"), "PUBLIC KEY", []byte("broken"))
+
+	if _, err := loadTrustStore(dir); err == nil {
+		t.Fatal("loaded a broken public key")
+	}
+}
+
+type testEntry struct {
+	name string
+	data []byte
+}
+
+func getTestTar(t *testing.T, entries ...testEntry) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+
+	for _, entry := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: entry.name, Mode: 0600, Size: int64(len(entry.data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestReadSignedImage(t *testing.T) {
+	image := append([]byte("RAON"), bytes.Repeat([]byte{0x5a}, 3*4096)...)
+
+	stream := getTestTar(t, testEntry{signatureEntry, []byte("signature")}, testEntry{imageEntry, image})
+	if !isSignedImage(stream) {
+		t.Fatal("signed layer is not detected")
+	}
+
+	signature, r, err := readSignedImage(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(signature) != "signature" {
+		t.Fatalf("signature = %q", signature)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, image) {
+		t.Fatalf("read %v bytes of image, expected %v", len(data), len(image))
+	}
+
+	// Plain raonfs images and ordinary layer tarballs are no signed layers
+	for _, source := range [][]byte{
+		image,
+		getTestTar(t, testEntry{imageEntry, image}, testEntry{signatureEntry, []byte("signature")}),
+		getTestTar(t, testEntry{"etc/hostname", []byte("overlit\n")}),
+	} {
+		if isSignedImage(source) {
+			t.Errorf("detected %q as signed layer", source[:16])
+		}
+	}
+
+	for _, stream := range [][]byte{
+		getTestTar(t, testEntry{signatureEntry, make([]byte, maxSignatureSize+1)}, testEntry{imageEntry, image}),
+		getTestTar(t, testEntry{signatureEntry, []byte("signature")}, testEntry{"etc/hostname", image}),
+		getTestTar(t, testEntry{signatureEntry, []byte("signature")}),
+	} {
+		if _, _, err := readSignedImage(bytes.NewReader(stream)); err == nil {
+			t.Error("read a broken signed layer")
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	signers := getTestSigners(t)
+
+	keys := []crypto.PublicKey{}
+	for _, signer := range signers {
+		keys = append(keys, signer.public)
+	}
+
+	for _, signer := range signers {
+		signature := &layerSignature{RootHash: testRootHash, Signature: signer.sign([]byte(testRootHash))}
+
+		if err := signature.verify(keys); err != nil {
+			t.Errorf("%v: %v", signer.name, err)
+		}
+
+		// Signatures only hold for the root hash they were made for
+		other := &layerSignature{RootHash: testRootHash[1:] + "0", Signature: signature.Signature}
+		if err := other.verify(keys); err == nil {
+			t.Errorf("%v: verified signature of another root hash", signer.name)
+		}
+	}
+
+	// Keys outside of the trust store are never trusted
+	signature := &layerSignature{RootHash: testRootHash, Signature: signers[0].sign([]byte(testRootHash))}
+	if err := signature.verify(keys[1:]); err == nil {
+		t.Error("verified signature of an untrusted key")
+	}
+	if err := signature.verify(nil); err == nil {
+		t.Error("verified signature without a trust store")
+	}
+}